@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,16 +18,66 @@ const (
 	StateOrderConfirmed RideState = "OrderConfirmed"
 	StateCarArrived     RideState = "CarArrived"
 	StateInTrip         RideState = "InTrip"
+	StateTripPaused     RideState = "TripPaused"
 	StateTripCompleted  RideState = "TripCompleted"
 	StateTripCancelled  RideState = "TripCancelled"
+	StateDisputed       RideState = "Disputed"
 )
 
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+type HistoryEntry struct {
+	At    time.Time
+	From  RideState
+	To    RideState
+	Event RideEvent
+}
+
 type RideOrder struct {
-	ID     string
-	State  RideState
-	CarID  string
-	Driver string
-	Rating int
+	ID             string
+	State          RideState
+	CarID          string
+	Driver         string
+	Rating         int
+	DriverRating   int
+	ETA            time.Duration
+	PickupLocation string
+	DisputeReason  string
+
+	DistanceKm     float64
+	WaitingMinutes float64
+	Surge          float64 // 0 is treated as no surge
+	Clock          Clock
+
+	tripCompleted bool
+	createdAt     time.Time
+	lastChange    time.Time
+	history       []HistoryEntry
+	pausedAt      time.Time
+	pausedTotal   time.Duration
+	rebooks       int
+
+	mu sync.Mutex // guards State and the fields updated by transitions
+}
+
+const (
+	baseFare         = 100.0
+	ratePerKm        = 25.0
+	waitingFeePerMin = 5.0
+)
+
+type FareDetail struct {
+	BaseFare        float64
+	DistanceCharge  float64
+	SurgeMultiplier float64
+	WaitingFee      float64
+	Total           float64
 }
 
 type RideEvent string
@@ -39,13 +93,19 @@ const (
 	EventPaymentSuccess  RideEvent = "paymentSuccess"
 	EventPaymentFailed   RideEvent = "paymentFailed"
 	EventChangeCar       RideEvent = "changeCar"
+	EventReassignDriver  RideEvent = "reassignDriver"
 	EventEmergencyCancel RideEvent = "emergencyCancel"
+	EventPauseTrip       RideEvent = "pauseTrip"
+	EventResumeTrip      RideEvent = "resumeTrip"
+	EventOpenDispute     RideEvent = "openDispute"
+	EventResolveDispute  RideEvent = "resolveDispute"
 )
 
 var transitions = map[RideState]map[RideEvent]RideState{
 	StateIdle: {
 		EventSelectCar:   StateCarSelected,
 		EventCancelOrder: StateTripCancelled,
+		EventOpenDispute: StateDisputed,
 	},
 	StateCarSelected: {
 		EventConfirmOrder: StateOrderConfirmed,
@@ -53,9 +113,10 @@ var transitions = map[RideState]map[RideEvent]RideState{
 		EventCancelOrder:  StateTripCancelled,
 	},
 	StateOrderConfirmed: {
-		EventCarArrived:  StateCarArrived,
-		EventCancelOrder: StateTripCancelled,
-		EventCarDelayed:  StateTripCancelled,
+		EventCarArrived:     StateCarArrived,
+		EventReassignDriver: StateOrderConfirmed,
+		EventCancelOrder:    StateTripCancelled,
+		EventCarDelayed:     StateTripCancelled,
 	},
 	StateCarArrived: {
 		EventStartTrip:   StateInTrip,
@@ -63,6 +124,11 @@ var transitions = map[RideState]map[RideEvent]RideState{
 	},
 	StateInTrip: {
 		EventEndTrip:         StateTripCompleted,
+		EventPauseTrip:       StateTripPaused,
+		EventEmergencyCancel: StateTripCancelled,
+	},
+	StateTripPaused: {
+		EventResumeTrip:      StateInTrip,
 		EventEmergencyCancel: StateTripCancelled,
 	},
 	StateTripCompleted: {
@@ -70,23 +136,247 @@ var transitions = map[RideState]map[RideEvent]RideState{
 		EventPaymentFailed:  StateTripCompleted,
 	},
 	StateTripCancelled: {},
+	StateDisputed: {
+		EventResolveDispute: StateIdle,
+	},
+}
+
+// happyPath is the event that moves each state forward when nothing goes
+// wrong.
+var happyPath = map[RideState]RideEvent{
+	StateIdle:           EventSelectCar,
+	StateCarSelected:    EventConfirmOrder,
+	StateOrderConfirmed: EventCarArrived,
+	StateCarArrived:     EventStartTrip,
+	StateInTrip:         EventEndTrip,
+	StateTripPaused:     EventResumeTrip,
+	StateTripCompleted:  EventPaymentSuccess,
+	StateDisputed:       EventResolveDispute,
+}
+
+func NewRideOrder(id string) *RideOrder {
+	r := &RideOrder{ID: id, State: StateIdle, Clock: realClock{}}
+	r.createdAt = r.now()
+	r.lastChange = r.createdAt
+	return r
+}
+
+// Replay applies a recorded event log to a fresh order, stopping at the
+// first event that is not valid from the state reached so far.
+func Replay(events []RideEvent) (*RideOrder, error) {
+	order := NewRideOrder("replay")
+	for i, event := range events {
+		if err := order.Transition(event); err != nil {
+			return nil, fmt.Errorf("replay event %d: %w", i, err)
+		}
+	}
+	return order, nil
+}
+
+// Rebook creates a fresh idle order from a cancelled one, keeping the pickup
+// location. The new order gets its own ID, numbered per original order, and
+// an empty history.
+func (r *RideOrder) Rebook() (*RideOrder, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.State != StateTripCancelled {
+		return nil, fmt.Errorf("only cancelled orders can be rebooked, order is %s", r.State)
+	}
+	r.rebooks++
+	order := NewRideOrder(fmt.Sprintf("%s-R%d", r.ID, r.rebooks))
+	order.PickupLocation = r.PickupLocation
+	if r.Clock != nil {
+		order.Clock = r.Clock
+		order.createdAt = order.now()
+		order.lastChange = order.createdAt
+	}
+	fmt.Printf("Order %s rebooked as %s\n", r.ID, order.ID)
+	return order, nil
+}
+
+func (r *RideOrder) now() time.Time {
+	if r.Clock == nil {
+		return time.Now()
+	}
+	return r.Clock.Now()
+}
+
+type TransitionEdge struct {
+	From  RideState
+	Event RideEvent
+}
+
+func TransitionsInto(state RideState) []TransitionEdge {
+	var edges []TransitionEdge
+	for from, events := range transitions {
+		for event, to := range events {
+			if to == state {
+				edges = append(edges, TransitionEdge{From: from, Event: event})
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].Event < edges[j].Event
+	})
+	return edges
+}
+
+func sortedStates() []RideState {
+	states := make([]RideState, 0, len(transitions))
+	for state := range transitions {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+	return states
+}
+
+// TerminalStates lists the states with no outgoing transitions.
+func TerminalStates() []RideState {
+	var states []RideState
+	for _, state := range sortedStates() {
+		if len(transitions[state]) == 0 {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// NonTerminalStates lists the states with at least one outgoing transition.
+func NonTerminalStates() []RideState {
+	var states []RideState
+	for _, state := range sortedStates() {
+		if len(transitions[state]) > 0 {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+func ExportDOT() string {
+	var sb strings.Builder
+	sb.WriteString("digraph RideOrder {\n")
+	states := sortedStates()
+	for _, state := range states {
+		if len(transitions[state]) == 0 {
+			fmt.Fprintf(&sb, "  %q [shape=doublecircle];\n", state)
+		} else {
+			fmt.Fprintf(&sb, "  %q [shape=circle];\n", state)
+		}
+	}
+	for _, from := range states {
+		events := make([]RideEvent, 0, len(transitions[from]))
+		for event := range transitions[from] {
+			events = append(events, event)
+		}
+		sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+		for _, event := range events {
+			fmt.Fprintf(&sb, "  %q -> %q [label=%q];\n", from, transitions[from][event], event)
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// IsStale reports whether a non-terminal order has gone more than maxIdle
+// without a transition. Orders with no known creation or transition time are
+// never stale.
+func IsStale(order *RideOrder, maxIdle time.Duration) bool {
+	order.mu.Lock()
+	defer order.mu.Unlock()
+	if len(transitions[order.State]) == 0 || order.lastChange.IsZero() {
+		return false
+	}
+	return order.now().Sub(order.lastChange) > maxIdle
 }
 
 func (r *RideOrder) CanTransition(event RideEvent) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.canTransition(event)
+}
+
+func (r *RideOrder) canTransition(event RideEvent) bool {
+	if event == EventOpenDispute && !r.tripCompleted {
+		return false
+	}
 	_, ok := transitions[r.State][event]
 	return ok
 }
 
+func (r *RideOrder) NextHappyPathEvent() (RideEvent, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	event, ok := happyPath[r.State]
+	if !ok || !r.canTransition(event) {
+		return "", false
+	}
+	return event, true
+}
+
+func (r *RideOrder) History() []HistoryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	history := make([]HistoryEntry, len(r.history))
+	copy(history, r.history)
+	return history
+}
+
+// TimeInStates sums the time spent in each state. Orders not built with
+// NewRideOrder have no creation time, so their initial state only counts
+// from the first transition onwards.
+func (r *RideOrder) TimeInStates() map[RideState]time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	durations := make(map[RideState]time.Duration)
+	since := r.createdAt
+	for _, h := range r.history {
+		if !since.IsZero() {
+			durations[h.From] += h.At.Sub(since)
+		}
+		since = h.At
+	}
+	if len(transitions[r.State]) > 0 && !since.IsZero() {
+		durations[r.State] += r.now().Sub(since)
+	}
+	return durations
+}
+
+func (r *RideOrder) CanCancel() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.canTransition(EventCancelOrder) || r.canTransition(EventEmergencyCancel)
+}
+
 func (r *RideOrder) Transition(event RideEvent) error {
-	if !r.CanTransition(event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.transition(event)
+}
+
+func (r *RideOrder) transition(event RideEvent) error {
+	if !r.canTransition(event) {
 		return fmt.Errorf("invalid transition: %s -> %s", r.State, event)
 	}
 	newState := transitions[r.State][event]
 	fmt.Printf("Order %s: %s -> %s\n", r.ID, r.State, newState)
+	now := r.now()
+	r.history = append(r.history, HistoryEntry{At: now, From: r.State, To: newState, Event: event})
+	if r.State == StateTripPaused {
+		r.pausedTotal += now.Sub(r.pausedAt)
+	}
+	if newState == StateTripPaused {
+		r.pausedAt = now
+	}
 	r.State = newState
+	r.lastChange = now
 
 	switch event {
 	case EventSelectCar:
+		r.tripCompleted = false
+		r.pausedTotal = 0
 		fmt.Println("Car selected.")
 	case EventConfirmOrder:
 		fmt.Println("Order confirmed. Car is on the way.")
@@ -94,7 +384,12 @@ func (r *RideOrder) Transition(event RideEvent) error {
 		fmt.Println("Car has arrived.")
 	case EventStartTrip:
 		fmt.Println("Trip started.")
+	case EventPauseTrip:
+		fmt.Println("Trip paused.")
+	case EventResumeTrip:
+		fmt.Println("Trip resumed.")
 	case EventEndTrip:
+		r.tripCompleted = true
 		fmt.Println("Trip completed. Payment pending.")
 	case EventCancelOrder, EventCarDelayed, EventEmergencyCancel:
 		fmt.Println("Order cancelled.")
@@ -102,20 +397,236 @@ func (r *RideOrder) Transition(event RideEvent) error {
 		fmt.Println("Payment successful.")
 	case EventPaymentFailed:
 		fmt.Println("Payment failed. Please try again.")
+	case EventOpenDispute:
+		fmt.Println("Dispute opened.")
+	case EventResolveDispute:
+		r.tripCompleted = false // a trip can only be disputed once
+		fmt.Println("Dispute resolved.")
 	}
 
 	return nil
 }
 
+// TransitionWith applies event-specific data before transitioning:
+// "carID" and "driver" on selectCar/changeCar, "distanceKm" and
+// "waitingMinutes" on endTrip. Other keys are ignored.
+func (r *RideOrder) TransitionWith(event RideEvent, data map[string]any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.canTransition(event) {
+		return fmt.Errorf("invalid transition: %s -> %s", r.State, event)
+	}
+	switch event {
+	case EventSelectCar, EventChangeCar:
+		carID, driver := r.CarID, r.Driver
+		if err := readData(data, "carID", &carID); err != nil {
+			return err
+		}
+		if err := readData(data, "driver", &driver); err != nil {
+			return err
+		}
+		r.CarID, r.Driver = carID, driver
+	case EventEndTrip:
+		distance, waiting := r.DistanceKm, r.WaitingMinutes
+		if err := readData(data, "distanceKm", &distance); err != nil {
+			return err
+		}
+		if err := readData(data, "waitingMinutes", &waiting); err != nil {
+			return err
+		}
+		r.DistanceKm, r.WaitingMinutes = distance, waiting
+	}
+	return r.transition(event)
+}
+
+func readData[T any](data map[string]any, key string, dst *T) error {
+	raw, ok := data[key]
+	if !ok {
+		return nil
+	}
+	value, ok := raw.(T)
+	if !ok {
+		return fmt.Errorf("%s: expected %T, got %T", key, *dst, raw)
+	}
+	*dst = value
+	return nil
+}
+
+// ReassignDriver swaps the driver and car of a confirmed order before the
+// car arrives. The swap is recorded in the history as a reassignDriver event.
+func (r *RideOrder) ReassignDriver(newDriver, newCarID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.canTransition(EventReassignDriver) {
+		return fmt.Errorf("cannot reassign driver in state %s", r.State)
+	}
+	if r.Driver == "" && r.CarID == "" {
+		return errors.New("no driver has been assigned yet")
+	}
+	if newDriver == "" || newCarID == "" {
+		return errors.New("new driver and car cannot be empty")
+	}
+	if err := r.transition(EventReassignDriver); err != nil {
+		return err
+	}
+	r.Driver, r.CarID = newDriver, newCarID
+	fmt.Printf("Order %s: your driver is now %s (car %s)\n", r.ID, newDriver, newCarID)
+	return nil
+}
+
+func (r *RideOrder) UpdatePickup(location string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.State {
+	case StateIdle, StateCarSelected, StateOrderConfirmed, StateCarArrived:
+	default:
+		return fmt.Errorf("cannot change pickup location in state %s", r.State)
+	}
+	if location == "" {
+		return errors.New("pickup location cannot be empty")
+	}
+	r.PickupLocation = location
+	fmt.Printf("Order %s: pickup location changed to %s\n", r.ID, location)
+	return nil
+}
+
+func (r *RideOrder) PauseTrip() error {
+	return r.Transition(EventPauseTrip)
+}
+
+func (r *RideOrder) ResumeTrip() error {
+	return r.Transition(EventResumeTrip)
+}
+
+// PausedDuration is the total time the current trip has spent paused,
+// including an ongoing pause. It is not billed as trip time.
+func (r *RideOrder) PausedDuration() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.State == StateTripPaused {
+		return r.pausedTotal + r.now().Sub(r.pausedAt)
+	}
+	return r.pausedTotal
+}
+
+func (r *RideOrder) surge() float64 {
+	if r.Surge <= 0 {
+		return 1
+	}
+	return r.Surge
+}
+
+func (r *RideOrder) FareBreakdown() (FareDetail, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.tripCompleted {
+		return FareDetail{}, errors.New("fare is only available once the trip is completed")
+	}
+	detail := FareDetail{
+		BaseFare:        baseFare,
+		DistanceCharge:  r.DistanceKm * ratePerKm,
+		SurgeMultiplier: r.surge(),
+		WaitingFee:      r.WaitingMinutes * waitingFeePerMin,
+	}
+	detail.Total = (detail.BaseFare+detail.DistanceCharge)*detail.SurgeMultiplier + detail.WaitingFee
+	return detail, nil
+}
+
+func (r *RideOrder) CalculateFare() (float64, error) {
+	detail, err := r.FareBreakdown()
+	if err != nil {
+		return 0, err
+	}
+	return detail.Total, nil
+}
+
+// QuoteFare estimates the fare before the trip. Waiting time is unknown at
+// this point, so the quote excludes the waiting fee.
+func (r *RideOrder) QuoteFare(estimatedKm float64) (float64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.State == StateIdle || r.State == StateTripCancelled {
+		return 0, fmt.Errorf("cannot quote a fare in state %s", r.State)
+	}
+	if estimatedKm < 0 {
+		return 0, errors.New("estimated distance cannot be negative")
+	}
+	return (baseFare + estimatedKm*ratePerKm) * r.surge(), nil
+}
+
+func (r *RideOrder) EstimatedDuration(avgSpeedKmh float64, distancesKm []float64) (time.Duration, error) {
+	r.mu.Lock()
+	state := r.State
+	r.mu.Unlock()
+	switch state {
+	case StateCarArrived, StateInTrip, StateTripPaused, StateTripCompleted:
+	default:
+		return 0, fmt.Errorf("cannot estimate duration in state %s", state)
+	}
+	if avgSpeedKmh <= 0 {
+		return 0, errors.New("average speed must be positive")
+	}
+	total := 0.0
+	for _, d := range distancesKm {
+		if d < 0 {
+			return 0, errors.New("segment distance cannot be negative")
+		}
+		total += d
+	}
+	hours := total / avgSpeedKmh
+	return time.Duration(hours * float64(time.Hour)), nil
+}
+
 func (r *RideOrder) SimulateDelay() {
-	if r.State == StateOrderConfirmed {
+	if r.CanTransition(EventCarDelayed) {
 		time.Sleep(2 * time.Second) // simulate waiting
 		fmt.Println("Car is delayed...")
 		r.Transition(EventCarDelayed)
 	}
 }
 
+func (r *RideOrder) WaitForArrival(ctx context.Context) error {
+	r.mu.Lock()
+	state := r.State
+	r.mu.Unlock()
+	if state != StateOrderConfirmed {
+		return fmt.Errorf("cannot wait for arrival in state %s", state)
+	}
+	timer := time.NewTimer(r.ETA)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return r.Transition(EventCarArrived)
+	}
+}
+
+// StartSelectionTimeout cancels the order if it is still in StateCarSelected
+// after d. Calling the returned function stops the timer early.
+func (r *RideOrder) StartSelectionTimeout(d time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.State == StateCarSelected {
+				fmt.Printf("Order %s: car selection timed out\n", r.ID)
+				r.transition(EventCancelOrder)
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
 func (r *RideOrder) SubmitRating(rating int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.State != StateIdle {
 		return errors.New("rating can only be submitted after the trip cycle is complete")
 	}
@@ -127,11 +638,47 @@ func (r *RideOrder) SubmitRating(rating int) error {
 	return nil
 }
 
-func main() {
-	order := &RideOrder{
-		ID:    "RIDE-001",
-		State: StateIdle,
+func (r *RideOrder) SubmitDriverRating(rating int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.State != StateIdle {
+		return errors.New("rating can only be submitted after the trip cycle is complete")
+	}
+	if rating < 1 || rating > 5 {
+		return errors.New("rating must be between 1 and 5")
+	}
+	r.DriverRating = rating
+	fmt.Printf("Driver rated the rider: %d\n", rating)
+	return nil
+}
+
+// Dispute reopens a completed trip cycle. Only idle orders whose last trip
+// was completed can be disputed.
+func (r *RideOrder) Dispute(reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reason == "" {
+		return errors.New("dispute reason cannot be empty")
+	}
+	if !r.canTransition(EventOpenDispute) {
+		return fmt.Errorf("cannot open a dispute in state %s without a completed trip", r.State)
 	}
+	r.DisputeReason = reason
+	return r.transition(EventOpenDispute)
+}
+
+func (r *RideOrder) ResolveDispute() error {
+	return r.Transition(EventResolveDispute)
+}
+
+func (r *RideOrder) AllRatings() (rider, driver int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Rating, r.DriverRating
+}
+
+func main() {
+	order := NewRideOrder("RIDE-001")
 
 	order.Transition(EventSelectCar)
 	order.Transition(EventConfirmOrder)
@@ -141,16 +688,23 @@ func main() {
 	order.Transition(EventPaymentSuccess)
 
 	order.SubmitRating(5)
+	order.Dispute("charged for the wrong route")
+	order.ResolveDispute()
 
 	fmt.Println("\n--- Scenario with cancellation ---")
-	order2 := &RideOrder{ID: "RIDE-002", State: StateIdle}
+	order2 := NewRideOrder("RIDE-002")
 	order2.Transition(EventSelectCar)
 	order2.Transition(EventCancelOrder)
 
 	fmt.Println("\n--- Scenario with delay ---")
-	order3 := &RideOrder{ID: "RIDE-003", State: StateIdle}
+	order3 := NewRideOrder("RIDE-003")
+	order3.ETA = 5 * time.Second
 	order3.Transition(EventSelectCar)
 	order3.Transition(EventConfirmOrder)
-	go order3.SimulateDelay()
-	time.Sleep(3 * time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := order3.WaitForArrival(ctx); err != nil {
+		fmt.Println("Car is delayed...")
+		order3.Transition(EventCarDelayed)
+	}
 }
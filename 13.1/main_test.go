@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newOrderAfter(t *testing.T, events ...RideEvent) *RideOrder {
+	t.Helper()
+	order := NewRideOrder("RIDE-TEST")
+	for _, event := range events {
+		if err := order.Transition(event); err != nil {
+			t.Fatalf("Transition(%s): %v", event, err)
+		}
+	}
+	return order
+}
+
+var toCarArrived = []RideEvent{EventSelectCar, EventConfirmOrder, EventCarArrived}
+
+func TestCanCancel(t *testing.T) {
+	if order := newOrderAfter(t, toCarArrived...); !order.CanCancel() {
+		t.Error("CanCancel() = false in CarArrived, want true")
+	}
+	if order := newOrderAfter(t, append(toCarArrived, EventStartTrip)...); !order.CanCancel() {
+		t.Error("CanCancel() = false in InTrip, want true (emergency cancel)")
+	}
+	if order := newOrderAfter(t, append(toCarArrived, EventStartTrip, EventEndTrip)...); order.CanCancel() {
+		t.Error("CanCancel() = true in TripCompleted, want false")
+	}
+	if order := newOrderAfter(t, EventSelectCar, EventCancelOrder); order.CanCancel() {
+		t.Error("CanCancel() = true in TripCancelled, want false")
+	}
+}
+
+func TestWaitForArrivalCancelled(t *testing.T) {
+	order := newOrderAfter(t, EventSelectCar, EventConfirmOrder)
+	order.ETA = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := order.WaitForArrival(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitForArrival: got %v, want context.Canceled", err)
+	}
+	if order.State != StateOrderConfirmed {
+		t.Errorf("state = %s, want %s", order.State, StateOrderConfirmed)
+	}
+}
+
+func TestWaitForArrivalAfterETA(t *testing.T) {
+	order := newOrderAfter(t, EventSelectCar, EventConfirmOrder)
+	order.ETA = time.Millisecond
+	if err := order.WaitForArrival(context.Background()); err != nil {
+		t.Fatalf("WaitForArrival: %v", err)
+	}
+	if order.State != StateCarArrived {
+		t.Errorf("state = %s, want %s", order.State, StateCarArrived)
+	}
+}
+
+func TestTransitionsInto(t *testing.T) {
+	got := TransitionsInto(StateCarSelected)
+	want := []TransitionEdge{
+		{From: StateCarSelected, Event: EventChangeCar},
+		{From: StateIdle, Event: EventSelectCar},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("TransitionsInto(CarSelected) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("edge %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if n := len(TransitionsInto(StateTripCancelled)); n < 5 {
+		t.Errorf("TransitionsInto(TripCancelled) has %d edges, want at least 5", n)
+	}
+}
+
+func TestExportDOT(t *testing.T) {
+	dot := ExportDOT()
+	for _, line := range []string{
+		`"Idle" -> "CarSelected" [label="selectCar"];`,
+		`"TripCancelled" [shape=doublecircle];`,
+		`"Idle" [shape=circle];`,
+	} {
+		if !strings.Contains(dot, line) {
+			t.Errorf("ExportDOT missing %s:\n%s", line, dot)
+		}
+	}
+}
+
+var fullTrip = []RideEvent{EventSelectCar, EventConfirmOrder, EventCarArrived, EventStartTrip, EventEndTrip, EventPaymentSuccess}
+
+func TestTwoWayRatings(t *testing.T) {
+	order := newOrderAfter(t, fullTrip[:5]...)
+	if err := order.SubmitDriverRating(4); err == nil {
+		t.Error("SubmitDriverRating before payment succeeded, want error")
+	}
+	order.Transition(EventPaymentSuccess)
+	if err := order.SubmitRating(5); err != nil {
+		t.Fatalf("SubmitRating: %v", err)
+	}
+	if err := order.SubmitDriverRating(6); err == nil {
+		t.Error("SubmitDriverRating(6) succeeded, want error")
+	}
+	if err := order.SubmitDriverRating(4); err != nil {
+		t.Fatalf("SubmitDriverRating: %v", err)
+	}
+	if rider, driver := order.AllRatings(); rider != 5 || driver != 4 {
+		t.Errorf("AllRatings() = %d, %d, want 5, 4", rider, driver)
+	}
+}
+
+func TestFareBreakdown(t *testing.T) {
+	order := newOrderAfter(t, toCarArrived...)
+	if _, err := order.FareBreakdown(); err == nil {
+		t.Error("FareBreakdown before the trip ended succeeded, want error")
+	}
+	order.Surge = 1.5
+	order.Transition(EventStartTrip)
+	if err := order.TransitionWith(EventEndTrip, map[string]any{"distanceKm": 10.0, "waitingMinutes": 4.0}); err != nil {
+		t.Fatalf("TransitionWith: %v", err)
+	}
+
+	detail, err := order.FareBreakdown()
+	if err != nil {
+		t.Fatalf("FareBreakdown: %v", err)
+	}
+	want := FareDetail{BaseFare: 100, DistanceCharge: 250, SurgeMultiplier: 1.5, WaitingFee: 20, Total: 545}
+	if detail != want {
+		t.Errorf("FareBreakdown = %+v, want %+v", detail, want)
+	}
+	if fare, _ := order.CalculateFare(); fare != detail.Total {
+		t.Errorf("CalculateFare = %.2f, want %.2f", fare, detail.Total)
+	}
+}
+
+func TestQuoteFare(t *testing.T) {
+	if _, err := NewRideOrder("RIDE-Q").QuoteFare(8); err == nil {
+		t.Error("QuoteFare in Idle succeeded, want error")
+	}
+	order := newOrderAfter(t, EventSelectCar)
+	order.Surge = 2
+	fare, err := order.QuoteFare(8)
+	if err != nil {
+		t.Fatalf("QuoteFare: %v", err)
+	}
+	if want := (baseFare + 8*ratePerKm) * 2; fare != want {
+		t.Errorf("QuoteFare(8) = %.2f, want %.2f", fare, want)
+	}
+	if _, err := order.QuoteFare(-1); err == nil {
+		t.Error("QuoteFare(-1) succeeded, want error")
+	}
+}
+
+func TestTransitionWith(t *testing.T) {
+	order := NewRideOrder("RIDE-TW")
+	if err := order.TransitionWith(EventSelectCar, map[string]any{"carID": "CAR-42", "driver": "Oleg", "colour": "red"}); err != nil {
+		t.Fatalf("TransitionWith: %v", err)
+	}
+	if order.State != StateCarSelected || order.CarID != "CAR-42" || order.Driver != "Oleg" {
+		t.Errorf("state %s car %q driver %q, want CarSelected CAR-42 Oleg", order.State, order.CarID, order.Driver)
+	}
+	if err := order.TransitionWith(EventChangeCar, map[string]any{"carID": 7}); err == nil {
+		t.Error("TransitionWith with a non-string carID succeeded, want error")
+	}
+	if order.CarID != "CAR-42" {
+		t.Errorf("CarID = %q after a rejected change, want CAR-42", order.CarID)
+	}
+}
+
+func TestUpdatePickup(t *testing.T) {
+	order := newOrderAfter(t, EventSelectCar, EventConfirmOrder)
+	if err := order.UpdatePickup("Red Square"); err != nil {
+		t.Fatalf("UpdatePickup: %v", err)
+	}
+	if order.PickupLocation != "Red Square" {
+		t.Errorf("PickupLocation = %q, want %q", order.PickupLocation, "Red Square")
+	}
+	order.Transition(EventCarArrived)
+	order.Transition(EventStartTrip)
+	if err := order.UpdatePickup("Arbat"); err == nil {
+		t.Error("UpdatePickup in InTrip succeeded, want error")
+	}
+	if order.PickupLocation != "Red Square" {
+		t.Errorf("PickupLocation = %q after rejected update, want %q", order.PickupLocation, "Red Square")
+	}
+}
+
+func TestStartSelectionTimeout(t *testing.T) {
+	// The confirmed order progresses before its timer starts, so the test does
+	// not race the timeout.
+	confirmed := newOrderAfter(t, EventSelectCar, EventConfirmOrder)
+	stopConfirmed := confirmed.StartSelectionTimeout(time.Millisecond)
+	defer stopConfirmed()
+	selected := newOrderAfter(t, EventSelectCar)
+	stop := selected.StartSelectionTimeout(time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for currentState(selected) == StateCarSelected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // let the confirmed order's timer fire too
+	if state := currentState(selected); state != StateTripCancelled {
+		t.Errorf("selected order is %s, want %s", state, StateTripCancelled)
+	}
+	if state := currentState(confirmed); state != StateOrderConfirmed {
+		t.Errorf("confirmed order is %s, want %s", state, StateOrderConfirmed)
+	}
+}
+
+func TestStartSelectionTimeoutStopped(t *testing.T) {
+	order := newOrderAfter(t, EventSelectCar)
+	stop := order.StartSelectionTimeout(5 * time.Millisecond)
+	stop()
+	stop()
+	time.Sleep(20 * time.Millisecond)
+	if state := currentState(order); state != StateCarSelected {
+		t.Errorf("order is %s after stop, want %s", state, StateCarSelected)
+	}
+}
+
+func currentState(r *RideOrder) RideState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.State
+}
+
+func TestEstimatedDuration(t *testing.T) {
+	if _, err := newOrderAfter(t, EventSelectCar).EstimatedDuration(30, []float64{10}); err == nil {
+		t.Error("EstimatedDuration in CarSelected succeeded, want error")
+	}
+	order := newOrderAfter(t, toCarArrived...)
+	got, err := order.EstimatedDuration(40, []float64{12, 8})
+	if err != nil {
+		t.Fatalf("EstimatedDuration: %v", err)
+	}
+	if got != 30*time.Minute {
+		t.Errorf("EstimatedDuration = %v, want 30m", got)
+	}
+	if _, err := order.EstimatedDuration(0, []float64{12}); err == nil {
+		t.Error("EstimatedDuration with zero speed succeeded, want error")
+	}
+	if _, err := order.EstimatedDuration(40, []float64{12, -1}); err == nil {
+		t.Error("EstimatedDuration with a negative segment succeeded, want error")
+	}
+}
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestTimeInStates(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	order := NewRideOrder("RIDE-T")
+	order.Clock = clock
+	order.createdAt = clock.Now()
+	for _, step := range []struct {
+		wait  time.Duration
+		event RideEvent
+	}{
+		{time.Minute, EventSelectCar},
+		{2 * time.Minute, EventChangeCar},
+		{3 * time.Minute, EventConfirmOrder},
+		{5 * time.Minute, EventCarArrived},
+	} {
+		clock.Advance(step.wait)
+		if err := order.Transition(step.event); err != nil {
+			t.Fatalf("Transition(%s): %v", step.event, err)
+		}
+	}
+	clock.Advance(4 * time.Minute)
+
+	got := order.TimeInStates()
+	want := map[RideState]time.Duration{
+		StateIdle:           time.Minute,
+		StateCarSelected:    5 * time.Minute,
+		StateOrderConfirmed: 5 * time.Minute,
+		StateCarArrived:     4 * time.Minute,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("TimeInStates = %v, want %v", got, want)
+	}
+	for state, d := range want {
+		if got[state] != d {
+			t.Errorf("time in %s = %v, want %v", state, got[state], d)
+		}
+	}
+}
+
+func TestRebook(t *testing.T) {
+	order := newOrderAfter(t, EventSelectCar)
+	order.UpdatePickup("Red Square")
+	if _, err := order.Rebook(); err == nil {
+		t.Error("Rebook of an active order succeeded, want error")
+	}
+	order.Transition(EventCancelOrder)
+
+	again, err := order.Rebook()
+	if err != nil {
+		t.Fatalf("Rebook: %v", err)
+	}
+	if again.ID != "RIDE-TEST-R1" || again.State != StateIdle || again.PickupLocation != "Red Square" {
+		t.Errorf("rebooked order: ID %q state %s pickup %q", again.ID, again.State, again.PickupLocation)
+	}
+	if len(again.History()) != 0 {
+		t.Errorf("rebooked order has %d history entries, want 0", len(again.History()))
+	}
+	if other, _ := order.Rebook(); other.ID != "RIDE-TEST-R2" {
+		t.Errorf("second rebook ID = %q, want RIDE-TEST-R2", other.ID)
+	}
+}
+
+func TestDispute(t *testing.T) {
+	if err := NewRideOrder("RIDE-D").Dispute("never rode"); err == nil {
+		t.Error("Dispute without a completed trip succeeded, want error")
+	}
+	order := newOrderAfter(t, fullTrip...)
+	if err := order.Dispute(""); err == nil {
+		t.Error("Dispute with an empty reason succeeded, want error")
+	}
+	if err := order.Dispute("wrong route"); err != nil {
+		t.Fatalf("Dispute: %v", err)
+	}
+	if order.State != StateDisputed || order.DisputeReason != "wrong route" {
+		t.Errorf("state %s reason %q, want Disputed and the reason", order.State, order.DisputeReason)
+	}
+	if err := order.ResolveDispute(); err != nil {
+		t.Fatalf("ResolveDispute: %v", err)
+	}
+	if order.State != StateIdle {
+		t.Errorf("state after resolve = %s, want Idle", order.State)
+	}
+	if err := order.Dispute("wrong route again"); err == nil {
+		t.Error("second Dispute of the same trip succeeded, want error")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	order := NewRideOrder("RIDE-P")
+	order.Clock = clock
+	for _, event := range append(toCarArrived, EventStartTrip) {
+		order.Transition(event)
+	}
+	if err := order.ResumeTrip(); err == nil {
+		t.Error("ResumeTrip while not paused succeeded, want error")
+	}
+	if err := order.PauseTrip(); err != nil {
+		t.Fatalf("PauseTrip: %v", err)
+	}
+	clock.Advance(3 * time.Minute)
+	if got := order.PausedDuration(); got != 3*time.Minute {
+		t.Errorf("PausedDuration during pause = %v, want 3m", got)
+	}
+	if _, err := order.EstimatedDuration(30, []float64{5}); err != nil {
+		t.Errorf("EstimatedDuration while paused: %v", err)
+	}
+	if err := order.ResumeTrip(); err != nil {
+		t.Fatalf("ResumeTrip: %v", err)
+	}
+	clock.Advance(10 * time.Minute)
+	order.PauseTrip()
+	clock.Advance(2 * time.Minute)
+	order.ResumeTrip()
+	if order.State != StateInTrip {
+		t.Errorf("state = %s, want InTrip", order.State)
+	}
+	if got := order.PausedDuration(); got != 5*time.Minute {
+		t.Errorf("PausedDuration = %v, want 5m", got)
+	}
+}
+
+func TestReassignDriver(t *testing.T) {
+	order := NewRideOrder("RIDE-R")
+	order.TransitionWith(EventSelectCar, map[string]any{"carID": "CAR-1", "driver": "Oleg"})
+	if err := order.ReassignDriver("Nina", "CAR-2"); err == nil {
+		t.Error("ReassignDriver before confirmation succeeded, want error")
+	}
+	order.Transition(EventConfirmOrder)
+	if err := order.ReassignDriver("Nina", "CAR-2"); err != nil {
+		t.Fatalf("ReassignDriver: %v", err)
+	}
+	if order.Driver != "Nina" || order.CarID != "CAR-2" || order.State != StateOrderConfirmed {
+		t.Errorf("driver %q car %q state %s, want Nina CAR-2 OrderConfirmed", order.Driver, order.CarID, order.State)
+	}
+	history := order.History()
+	if last := history[len(history)-1]; last.Event != EventReassignDriver {
+		t.Errorf("last history event = %s, want %s", last.Event, EventReassignDriver)
+	}
+	order.Transition(EventCarArrived)
+	if err := order.ReassignDriver("Pavel", "CAR-3"); err == nil {
+		t.Error("ReassignDriver after arrival succeeded, want error")
+	}
+	if order.Driver != "Nina" {
+		t.Errorf("driver = %q after rejected reassignment, want Nina", order.Driver)
+	}
+}
+
+func TestTerminalStates(t *testing.T) {
+	terminal := TerminalStates()
+	if len(terminal) != 1 || terminal[0] != StateTripCancelled {
+		t.Errorf("TerminalStates() = %v, want [%s]", terminal, StateTripCancelled)
+	}
+	nonTerminal := NonTerminalStates()
+	found := false
+	for _, state := range nonTerminal {
+		if state == StateTripCancelled {
+			t.Errorf("NonTerminalStates() includes %s", state)
+		}
+		found = found || state == StateInTrip
+	}
+	if !found {
+		t.Errorf("NonTerminalStates() = %v, missing %s", nonTerminal, StateInTrip)
+	}
+	if len(terminal)+len(nonTerminal) != len(transitions) {
+		t.Errorf("%d terminal + %d non-terminal states, want %d in total", len(terminal), len(nonTerminal), len(transitions))
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	order := NewRideOrder("RIDE-S")
+	order.Clock = clock
+	order.Transition(EventSelectCar)
+	clock.Advance(10 * time.Minute)
+	if IsStale(order, 15*time.Minute) {
+		t.Error("order idle for 10m is stale with a 15m threshold")
+	}
+	clock.Advance(10 * time.Minute)
+	if !IsStale(order, 15*time.Minute) {
+		t.Error("order idle for 20m is not stale with a 15m threshold")
+	}
+	order.Transition(EventCancelOrder)
+	clock.Advance(time.Hour)
+	if IsStale(order, 15*time.Minute) {
+		t.Error("cancelled order is reported stale")
+	}
+}
+
+func TestNextHappyPathEvent(t *testing.T) {
+	order := NewRideOrder("RIDE-H")
+	var walked []RideEvent
+	for len(walked) < 10 {
+		event, ok := order.NextHappyPathEvent()
+		if !ok {
+			t.Fatalf("no happy-path event from %s", order.State)
+		}
+		if err := order.Transition(event); err != nil {
+			t.Fatalf("Transition(%s): %v", event, err)
+		}
+		walked = append(walked, event)
+		if order.State == StateIdle {
+			break
+		}
+	}
+	if len(walked) != len(fullTrip) {
+		t.Fatalf("walked %v, want %v", walked, fullTrip)
+	}
+	for i := range fullTrip {
+		if walked[i] != fullTrip[i] {
+			t.Errorf("step %d = %s, want %s", i, walked[i], fullTrip[i])
+		}
+	}
+
+	cancelled := newOrderAfter(t, EventSelectCar, EventCancelOrder)
+	if event, ok := cancelled.NextHappyPathEvent(); ok {
+		t.Errorf("NextHappyPathEvent in TripCancelled = %s, want none", event)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	order, err := Replay(fullTrip)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if order.State != StateIdle || len(order.History()) != len(fullTrip) {
+		t.Errorf("replayed order: state %s with %d history entries", order.State, len(order.History()))
+	}
+
+	order, err = Replay([]RideEvent{EventSelectCar, EventConfirmOrder, EventEndTrip})
+	if err == nil || !strings.Contains(err.Error(), "event 2") {
+		t.Errorf("Replay of an illegal log: got %v, want an error naming event 2", err)
+	}
+	if order != nil {
+		t.Errorf("Replay returned order in state %s alongside the error", order.State)
+	}
+}
@@ -1,10 +1,42 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var (
+	ErrNotAdmin            = errors.New("admin access required")
+	ErrNotRegistered       = errors.New("only registered users can book")
+	ErrNotOwner            = errors.New("you can only cancel your own bookings")
+	ErrEventNotFound       = errors.New("event not found")
+	ErrBookingNotFound     = errors.New("booking not found")
+	ErrBookingNotActive    = errors.New("booking is not active")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrSoldOut             = errors.New("event is sold out")
+	ErrInsufficientRole    = errors.New("insufficient role for this event")
+	ErrCancellationClosed  = errors.New("cancellation deadline has passed")
+	ErrWaitlistDisabled    = errors.New("waitlist disabled for this event")
+	ErrSeatsAvailable      = errors.New("event still has seats available")
+	ErrAlreadyWaitlisted   = errors.New("user already on the waitlist")
+	ErrNotWaitlisted       = errors.New("user not on the waitlist")
+	ErrCapacityTooLow      = errors.New("capacity below existing bookings")
+	ErrNotAttended         = errors.New("only attendees of past events can leave reviews")
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationExpired  = errors.New("reservation expired")
+	ErrTimeConflict        = errors.New("time conflict with another booking")
+	ErrVenueUnavailable    = errors.New("venue unavailable on that date")
+)
+
 type Role string
 
 const (
@@ -13,6 +45,14 @@ const (
 	RoleAdmin Role = "admin"
 )
 
+var roleRank = map[Role]int{
+	RoleGuest: 0,
+	RoleUser:  1,
+	RoleAdmin: 2,
+}
+
+const dateLayout = "2006-01-02 15:04"
+
 type User struct {
 	ID   int
 	Name string
@@ -20,10 +60,30 @@ type User struct {
 }
 
 type Event struct {
-	ID    int
-	Title string
-	Date  time.Time
-	Venue string
+	ID              int
+	Title           string
+	Date            time.Time
+	Duration        time.Duration
+	Venue           string
+	Capacity        int // 0 means unlimited
+	Price           float64
+	RequiredRole    Role
+	WaitlistEnabled bool
+	Deleted         bool
+}
+
+func (e *Event) overlaps(other *Event) bool {
+	if e.Date.Equal(other.Date) {
+		return true
+	}
+	return e.Date.Before(other.Date.Add(other.Duration)) && other.Date.Before(e.Date.Add(e.Duration))
+}
+
+func (e *Event) requiredRole() Role {
+	if e.RequiredRole == "" {
+		return RoleUser
+	}
+	return e.RequiredRole
 }
 
 type BookingStatus string
@@ -34,126 +94,1356 @@ const (
 )
 
 type Booking struct {
-	ID     int
-	User   *User
-	Event  *Event
-	Status BookingStatus
+	ID          int
+	User        *User
+	Event       *Event
+	Status      BookingStatus
+	CreatedAt   time.Time
+	CancelledAt time.Time
+
+	system *BookingSystem
+}
+
+func (b *Booking) DisplayID() string {
+	if b.system != nil && b.system.BookingIDFormat != nil {
+		return b.system.BookingIDFormat(b.ID)
+	}
+	return strconv.Itoa(b.ID)
+}
+
+type Notifier interface {
+	Notify(user *User, message string)
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+type ConsoleNotifier struct{}
+
+func (ConsoleNotifier) Notify(user *User, message string) {
+	fmt.Printf("Notification to %s: %s\n", user.Name, message)
+}
+
+type Reservation struct {
+	ID        int
+	User      *User
+	Event     *Event
+	ExpiresAt time.Time
+}
+
+type Review struct {
+	UserID    int
+	EventID   int
+	Rating    int
+	Text      string
+	CreatedAt time.Time
+}
+
+type ActivityEntry struct {
+	At      time.Time
+	Action  string // "book", "cancel" or "review"
+	EventID int
+	Detail  string
+}
+
+type AuditEntry struct {
+	ActorID   int
+	Action    string
+	TargetID  int
+	Timestamp time.Time
 }
 
 type BookingSystem struct {
-	events        []*Event
-	users         []*User
-	bookings      []*Booking
-	nextEventID   int
-	nextBookingID int
+	events            []*Event
+	users             []*User
+	bookings          []*Booking
+	auditLog          []AuditEntry
+	waitlists         map[int][]*User
+	reviews           []Review
+	reservations      []*Reservation
+	nextEventID       int
+	nextBookingID     int
+	nextReservationID int
+
+	Notifier        Notifier
+	BookingIDFormat func(int) string // nil renders the plain numeric ID
+	Clock           Clock
+
+	// WaitlistPriority reports whether a should be promoted ahead of b.
+	// Nil keeps the waitlist in join order.
+	WaitlistPriority func(a, b *User) bool
+
+	// Bookings cannot be cancelled less than CancellationDeadline before
+	// the event, unless they were made within the last GracePeriod.
+	CancellationDeadline time.Duration
+	GracePeriod          time.Duration
+	LateCancellationFee  float64
+
+	BlackoutDates map[string][]time.Time // venue -> days no events can be scheduled
+
+	// UserTier is "silver" from SilverBookings non-cancelled bookings and
+	// "gold" from GoldBookings; below that it is "bronze".
+	SilverBookings int
+	GoldBookings   int
 }
 
 func NewBookingSystem() *BookingSystem {
 	return &BookingSystem{
-		events:        make([]*Event, 0),
-		users:         make([]*User, 0),
-		bookings:      make([]*Booking, 0),
-		nextEventID:   1,
-		nextBookingID: 1,
+		events:            make([]*Event, 0),
+		users:             make([]*User, 0),
+		bookings:          make([]*Booking, 0),
+		auditLog:          make([]AuditEntry, 0),
+		waitlists:         make(map[int][]*User),
+		nextEventID:       1,
+		nextBookingID:     1,
+		nextReservationID: 1,
+		Notifier:          ConsoleNotifier{},
+		Clock:             realClock{},
+		SilverBookings:    5,
+		GoldBookings:      15,
+	}
+}
+
+func (s *BookingSystem) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
+}
+
+func (s *BookingSystem) Reset() {
+	s.events = make([]*Event, 0)
+	s.users = make([]*User, 0)
+	s.bookings = make([]*Booking, 0)
+	s.auditLog = make([]AuditEntry, 0)
+	s.waitlists = make(map[int][]*User)
+	s.reviews = nil
+	s.reservations = nil
+	s.nextEventID = 1
+	s.nextBookingID = 1
+	s.nextReservationID = 1
+}
+
+func (s *BookingSystem) RegisterUser(user *User) error {
+	if s.findUser(user.ID) != nil {
+		return fmt.Errorf("user ID %d already registered", user.ID)
+	}
+	s.users = append(s.users, user)
+	return nil
+}
+
+func (s *BookingSystem) findUser(userID int) *User {
+	for _, u := range s.users {
+		if u.ID == userID {
+			return u
+		}
 	}
+	return nil
+}
+
+// mergeWaitlists replaces the removed user with keep on every waitlist. If
+// both were waiting for the same event, keep holds the earlier position.
+func (s *BookingSystem) mergeWaitlists(keep *User, removeID int) {
+	for eventID, waitlist := range s.waitlists {
+		merged := waitlist[:0]
+		seen := false
+		for _, u := range waitlist {
+			if u.ID == removeID {
+				u = keep
+			}
+			if u.ID == keep.ID {
+				if seen {
+					continue
+				}
+				seen = true
+			}
+			merged = append(merged, u)
+		}
+		s.waitlists[eventID] = merged
+	}
+}
+
+// mergeReviews moves the removed user's reviews to keepID, dropping any for
+// events keepID has already reviewed.
+func (s *BookingSystem) mergeReviews(keepID, removeID int) {
+	reviewed := make(map[int]bool)
+	for _, r := range s.reviews {
+		if r.UserID == keepID {
+			reviewed[r.EventID] = true
+		}
+	}
+	merged := s.reviews[:0]
+	for _, r := range s.reviews {
+		if r.UserID == removeID {
+			if reviewed[r.EventID] {
+				continue
+			}
+			r.UserID = keepID
+		}
+		merged = append(merged, r)
+	}
+	s.reviews = merged
+}
+
+func (s *BookingSystem) MergeUsers(keepID, removeID int, admin *User) error {
+	if admin.Role != RoleAdmin {
+		return fmt.Errorf("cannot merge users: %w", ErrNotAdmin)
+	}
+	if keepID == removeID {
+		return fmt.Errorf("cannot merge a user into itself")
+	}
+	keep := s.findUser(keepID)
+	if keep == nil {
+		return ErrUserNotFound
+	}
+	for i, u := range s.users {
+		if u.ID != removeID {
+			continue
+		}
+		for _, b := range s.bookings {
+			if b.User.ID == removeID {
+				b.User = keep
+			}
+		}
+		for _, r := range s.reservations {
+			if r.User.ID == removeID {
+				r.User = keep
+			}
+		}
+		s.mergeWaitlists(keep, removeID)
+		s.mergeReviews(keepID, removeID)
+		s.users = append(s.users[:i], s.users[i+1:]...)
+		s.audit(admin, "merge_users", removeID)
+		fmt.Printf("User ID %d merged into user ID %d\n", removeID, keepID)
+		return nil
+	}
+	return ErrUserNotFound
+}
+
+type bookingRecord struct {
+	ID          int
+	UserID      int
+	EventID     int
+	Status      BookingStatus
+	CreatedAt   time.Time
+	CancelledAt time.Time
+}
+
+type reservationRecord struct {
+	ID        int
+	UserID    int
+	EventID   int
+	ExpiresAt time.Time
+}
+
+type systemSnapshot struct {
+	Events            []*Event
+	Users             []*User
+	Bookings          []bookingRecord
+	Waitlists         map[int][]int
+	Reservations      []reservationRecord
+	Reviews           []Review
+	AuditLog          []AuditEntry
+	NextEventID       int
+	NextBookingID     int
+	NextReservationID int
+}
+
+func (s *BookingSystem) SaveToFile(path string) error {
+	snap := systemSnapshot{
+		Events:            s.events,
+		Users:             s.users,
+		Bookings:          make([]bookingRecord, 0, len(s.bookings)),
+		Waitlists:         make(map[int][]int),
+		Reviews:           s.reviews,
+		AuditLog:          s.auditLog,
+		NextEventID:       s.nextEventID,
+		NextBookingID:     s.nextBookingID,
+		NextReservationID: s.nextReservationID,
+	}
+	for _, b := range s.bookings {
+		snap.Bookings = append(snap.Bookings, bookingRecord{
+			ID:          b.ID,
+			UserID:      b.User.ID,
+			EventID:     b.Event.ID,
+			Status:      b.Status,
+			CreatedAt:   b.CreatedAt,
+			CancelledAt: b.CancelledAt,
+		})
+	}
+	for eventID, users := range s.waitlists {
+		for _, u := range users {
+			snap.Waitlists[eventID] = append(snap.Waitlists[eventID], u.ID)
+		}
+	}
+	for _, r := range s.reservations {
+		snap.Reservations = append(snap.Reservations, reservationRecord{
+			ID:        r.ID,
+			UserID:    r.User.ID,
+			EventID:   r.Event.ID,
+			ExpiresAt: r.ExpiresAt,
+		})
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// LoadFromFile replaces the system state with the contents of path. Bookings,
+// reservations and waitlists are re-linked to the loaded users and events by ID; the
+// current state is left untouched if the file cannot be loaded.
+func (s *BookingSystem) LoadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snap systemSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	loaded := NewBookingSystem()
+	loaded.events = append(loaded.events, snap.Events...)
+	loaded.users = append(loaded.users, snap.Users...)
+	loaded.auditLog = append(loaded.auditLog, snap.AuditLog...)
+	eventsByID := make(map[int]*Event, len(snap.Events))
+	for _, e := range snap.Events {
+		eventsByID[e.ID] = e
+	}
+	for _, rec := range snap.Bookings {
+		user := loaded.findUser(rec.UserID)
+		if user == nil {
+			return fmt.Errorf("booking %d: %w", rec.ID, ErrUserNotFound)
+		}
+		event := eventsByID[rec.EventID]
+		if event == nil {
+			return fmt.Errorf("booking %d: %w", rec.ID, ErrEventNotFound)
+		}
+		loaded.bookings = append(loaded.bookings, &Booking{
+			ID:          rec.ID,
+			User:        user,
+			Event:       event,
+			Status:      rec.Status,
+			CreatedAt:   rec.CreatedAt,
+			CancelledAt: rec.CancelledAt,
+			system:      s,
+		})
+	}
+	for eventID, userIDs := range snap.Waitlists {
+		for _, id := range userIDs {
+			user := loaded.findUser(id)
+			if user == nil {
+				return fmt.Errorf("waitlist for event %d: %w", eventID, ErrUserNotFound)
+			}
+			loaded.waitlists[eventID] = append(loaded.waitlists[eventID], user)
+		}
+	}
+	for _, rec := range snap.Reservations {
+		user := loaded.findUser(rec.UserID)
+		if user == nil {
+			return fmt.Errorf("reservation %d: %w", rec.ID, ErrUserNotFound)
+		}
+		event := eventsByID[rec.EventID]
+		if event == nil {
+			return fmt.Errorf("reservation %d: %w", rec.ID, ErrEventNotFound)
+		}
+		loaded.reservations = append(loaded.reservations, &Reservation{
+			ID:        rec.ID,
+			User:      user,
+			Event:     event,
+			ExpiresAt: rec.ExpiresAt,
+		})
+	}
+	loaded.reviews = append(loaded.reviews, snap.Reviews...)
+
+	s.events = loaded.events
+	s.users = loaded.users
+	s.bookings = loaded.bookings
+	s.auditLog = loaded.auditLog
+	s.waitlists = loaded.waitlists
+	s.reservations = loaded.reservations
+	s.reviews = loaded.reviews
+	s.nextEventID = snap.NextEventID
+	s.nextBookingID = snap.NextBookingID
+	s.nextReservationID = max(snap.NextReservationID, 1)
+	return nil
+}
+
+// ExportEventsCSV writes the visible events as CSV, one row per event
+// after an id,title,date,venue,capacity header.
+func (s *BookingSystem) ExportEventsCSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write([]string{"id", "title", "date", "venue", "capacity"}); err != nil {
+		return nil, err
+	}
+	for _, e := range s.visibleEvents() {
+		record := []string{
+			strconv.Itoa(e.ID),
+			e.Title,
+			e.Date.Format(time.RFC3339),
+			e.Venue,
+			strconv.Itoa(e.Capacity),
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func (s *BookingSystem) AddEvent(title string, date time.Time, venue string, admin *User) error {
 	if admin.Role != RoleAdmin {
-		return fmt.Errorf("only admin can add events")
+		return fmt.Errorf("cannot add events: %w", ErrNotAdmin)
+	}
+	if s.blackedOut(venue, date) {
+		return ErrVenueUnavailable
+	}
+	event := s.addEvent(title, date, venue)
+	s.audit(admin, "add_event", event.ID)
+	return nil
+}
+
+func (s *BookingSystem) AddRecurringEvent(title string, first time.Time, venue string, count int, interval time.Duration, admin *User) ([]*Event, error) {
+	if admin.Role != RoleAdmin {
+		return nil, fmt.Errorf("cannot add events: %w", ErrNotAdmin)
+	}
+	if count <= 0 {
+		return nil, fmt.Errorf("count must be positive")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive")
+	}
+	if !first.After(s.now()) {
+		return nil, fmt.Errorf("first event date must be in the future")
+	}
+	for i := 0; i < count; i++ {
+		if s.blackedOut(venue, first.Add(time.Duration(i)*interval)) {
+			return nil, ErrVenueUnavailable
+		}
+	}
+	events := make([]*Event, 0, count)
+	for i := 0; i < count; i++ {
+		date := first.Add(time.Duration(i) * interval)
+		event := s.addEvent(title, date, venue)
+		s.audit(admin, "add_event", event.ID)
+		events = append(events, event)
 	}
+	return events, nil
+}
+
+func (s *BookingSystem) addEvent(title string, date time.Time, venue string) *Event {
 	event := &Event{
-		ID:    s.nextEventID,
-		Title: title,
-		Date:  date,
-		Venue: venue,
+		ID:              s.nextEventID,
+		Title:           title,
+		Date:            date,
+		Venue:           venue,
+		RequiredRole:    RoleUser,
+		WaitlistEnabled: true,
 	}
 	s.events = append(s.events, event)
 	s.nextEventID++
 	fmt.Printf("Event '%s' added (ID: %d)\n", title, event.ID)
-	return nil
+	return event
 }
 
 func (s *BookingSystem) UpdateEvent(eventID int, title string, date time.Time, venue string, admin *User) error {
 	if admin.Role != RoleAdmin {
-		return fmt.Errorf("only admin can edit events")
+		return fmt.Errorf("cannot edit events: %w", ErrNotAdmin)
 	}
-	for _, e := range s.events {
-		if e.ID == eventID {
-			e.Title = title
-			e.Date = date
-			e.Venue = venue
-			fmt.Printf("Event ID %d updated\n", eventID)
-			return nil
-		}
+	e := s.findEvent(eventID)
+	if e == nil {
+		return ErrEventNotFound
 	}
-	return fmt.Errorf("event not found")
+	if s.blackedOut(venue, date) {
+		return ErrVenueUnavailable
+	}
+	e.Title = title
+	e.Date = date
+	e.Venue = venue
+	s.audit(admin, "update_event", eventID)
+	fmt.Printf("Event ID %d updated\n", eventID)
+	return nil
 }
 
 func (s *BookingSystem) DeleteEvent(eventID int, admin *User) error {
 	if admin.Role != RoleAdmin {
-		return fmt.Errorf("only admin can delete events")
+		return fmt.Errorf("cannot delete events: %w", ErrNotAdmin)
 	}
 	for i, e := range s.events {
 		if e.ID == eventID {
 			s.events = append(s.events[:i], s.events[i+1:]...)
+			delete(s.waitlists, eventID)
+			s.dropReservations(eventID)
+			s.audit(admin, "delete_event", eventID)
 			fmt.Printf("Event ID %d deleted\n", eventID)
 			return nil
 		}
 	}
-	return fmt.Errorf("event not found")
+	return ErrEventNotFound
+}
+
+// BroadcastToEvent notifies every user with an active booking for the event
+// once, however many tickets they hold, and returns how many were notified.
+func (s *BookingSystem) BroadcastToEvent(eventID int, message string, admin *User) (int, error) {
+	if admin.Role != RoleAdmin {
+		return 0, fmt.Errorf("cannot broadcast: %w", ErrNotAdmin)
+	}
+	if s.findEvent(eventID) == nil {
+		return 0, ErrEventNotFound
+	}
+	notified := make(map[int]bool)
+	for _, b := range s.bookings {
+		if b.Event.ID != eventID || b.Status != StatusActive || notified[b.User.ID] {
+			continue
+		}
+		s.Notifier.Notify(b.User, message)
+		notified[b.User.ID] = true
+	}
+	s.audit(admin, "broadcast", eventID)
+	return len(notified), nil
+}
+
+// PurgeCancelledBefore removes cancelled bookings for events dated before
+// cutoff and returns how many were removed.
+func (s *BookingSystem) PurgeCancelledBefore(cutoff time.Time, admin *User) (int, error) {
+	if admin.Role != RoleAdmin {
+		return 0, fmt.Errorf("cannot purge bookings: %w", ErrNotAdmin)
+	}
+	kept := s.bookings[:0]
+	purged := 0
+	for _, b := range s.bookings {
+		if b.Status == StatusCancelled && b.Event != nil && b.Event.Date.Before(cutoff) {
+			s.audit(admin, "purge_booking", b.ID)
+			purged++
+			continue
+		}
+		kept = append(kept, b)
+	}
+	s.bookings = kept
+	fmt.Printf("%d cancelled booking(s) purged\n", purged)
+	return purged, nil
+}
+
+// AdjustCapacity sets a new capacity (0 means unlimited) and promotes
+// waitlisted users into any seats that open up.
+func (s *BookingSystem) AdjustCapacity(eventID int, newCapacity int, admin *User) error {
+	if admin.Role != RoleAdmin {
+		return fmt.Errorf("cannot adjust capacity: %w", ErrNotAdmin)
+	}
+	e := s.findEvent(eventID)
+	if e == nil {
+		return ErrEventNotFound
+	}
+	if newCapacity < 0 {
+		return fmt.Errorf("capacity cannot be negative")
+	}
+	if newCapacity > 0 && newCapacity < s.seatsTaken(eventID) {
+		return ErrCapacityTooLow
+	}
+	e.Capacity = newCapacity
+	s.audit(admin, "adjust_capacity", eventID)
+	fmt.Printf("Event ID %d capacity set to %d\n", eventID, newCapacity)
+	s.promoteWaitlist(e)
+	return nil
+}
+
+// visibleEvents returns the events that have not been soft-deleted.
+func (s *BookingSystem) visibleEvents() []*Event {
+	visible := make([]*Event, 0, len(s.events))
+	for _, e := range s.events {
+		if !e.Deleted {
+			visible = append(visible, e)
+		}
+	}
+	return visible
+}
+
+// blackedOut matches venues case-insensitively, like the other venue lookups.
+func (s *BookingSystem) blackedOut(venue string, date time.Time) bool {
+	for v, dates := range s.BlackoutDates {
+		if !strings.EqualFold(v, venue) {
+			continue
+		}
+		for _, d := range dates {
+			if sameDay(date, d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameDay(a, b time.Time) bool {
+	a = a.In(b.Location())
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// CancelEventsOnDate soft-deletes every event on the calendar day of date,
+// cancelling and notifying its active bookings and clearing its waitlist.
+func (s *BookingSystem) CancelEventsOnDate(date time.Time, admin *User) (int, error) {
+	if admin.Role != RoleAdmin {
+		return 0, fmt.Errorf("cannot cancel events: %w", ErrNotAdmin)
+	}
+	affected := 0
+	for _, e := range s.visibleEvents() {
+		if !sameDay(e.Date, date) {
+			continue
+		}
+		for _, b := range s.bookings {
+			if b.Event.ID != e.ID || b.Status != StatusActive {
+				continue
+			}
+			b.Status = StatusCancelled
+			b.CancelledAt = s.now()
+			s.audit(admin, "cancel_booking", b.ID)
+			s.Notifier.Notify(b.User, fmt.Sprintf("Event '%s' on %s has been cancelled", e.Title, e.Date.Format(dateLayout)))
+		}
+		delete(s.waitlists, e.ID)
+		s.dropReservations(e.ID)
+		e.Deleted = true
+		s.audit(admin, "cancel_event", e.ID)
+		affected++
+	}
+	fmt.Printf("%d event(s) on %s cancelled\n", affected, date.Format("2006-01-02"))
+	return affected, nil
+}
+
+func (s *BookingSystem) findEvent(eventID int) *Event {
+	for _, e := range s.visibleEvents() {
+		if e.ID == eventID {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *BookingSystem) activeBookingCount(eventID int) int {
+	count := 0
+	for _, b := range s.bookings {
+		if b.Event.ID == eventID && b.Status == StatusActive {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *BookingSystem) audit(actor *User, action string, targetID int) {
+	s.auditLog = append(s.auditLog, AuditEntry{
+		ActorID:   actor.ID,
+		Action:    action,
+		TargetID:  targetID,
+		Timestamp: s.now(),
+	})
+}
+
+func (s *BookingSystem) AuditLog(admin *User) ([]AuditEntry, error) {
+	if admin.Role != RoleAdmin {
+		return nil, fmt.Errorf("cannot view audit log: %w", ErrNotAdmin)
+	}
+	entries := make([]AuditEntry, len(s.auditLog))
+	copy(entries, s.auditLog)
+	return entries, nil
+}
+
+// seatsTaken counts active bookings plus unexpired reservations.
+func (s *BookingSystem) seatsTaken(eventID int) int {
+	taken := s.activeBookingCount(eventID)
+	now := s.now()
+	for _, r := range s.reservations {
+		if r.Event.ID == eventID && now.Before(r.ExpiresAt) {
+			taken++
+		}
+	}
+	return taken
+}
+
+// IsSoldOut reports whether every seat is booked or held by a reservation.
+// Unlimited-capacity events are never sold out.
+func (s *BookingSystem) IsSoldOut(eventID int) (bool, error) {
+	e := s.findEvent(eventID)
+	if e == nil {
+		return false, ErrEventNotFound
+	}
+	return e.Capacity > 0 && s.seatsTaken(e.ID) >= e.Capacity, nil
 }
 
 func (s *BookingSystem) ListEvents() {
-	if len(s.events) == 0 {
+	if len(s.visibleEvents()) == 0 {
 		fmt.Println("No events available")
 		return
 	}
 	fmt.Println("\nAvailable events:")
-	for _, e := range s.events {
-		fmt.Printf("ID: %d | %s | %s | %s\n",
-			e.ID, e.Title, e.Date.Format("2006-01-02 15:04"), e.Venue)
+	fmt.Print(s.formatEvents())
+}
+
+func (s *BookingSystem) formatEvents() string {
+	var sb strings.Builder
+	for _, e := range s.visibleEvents() {
+		fmt.Fprintf(&sb, "ID: %d | %s | %s | %s\n",
+			e.ID, e.Title, e.Date.Format(dateLayout), e.Venue)
 	}
+	return sb.String()
 }
 
-func (s *BookingSystem) BookEvent(userID, eventID int, user *User) error {
-	if user.Role != RoleUser {
-		return fmt.Errorf("only registered users can book")
+func (s *BookingSystem) NextEventAtVenue(venue string) (*Event, error) {
+	now := s.now()
+	var next *Event
+	for _, e := range s.visibleEvents() {
+		if !strings.EqualFold(e.Venue, venue) || !e.Date.After(now) {
+			continue
+		}
+		if next == nil || e.Date.Before(next.Date) {
+			next = e
+		}
 	}
-	var targetEvent *Event
-	for _, e := range s.events {
-		if e.ID == eventID {
-			targetEvent = e
-			break
+	if next == nil {
+		return nil, fmt.Errorf("no upcoming events at venue")
+	}
+	return next, nil
+}
+
+func (s *BookingSystem) checkEligibility(e *Event, user *User) error {
+	if roleRank[user.Role] < roleRank[e.requiredRole()] {
+		if user.Role == RoleGuest {
+			return ErrNotRegistered
+		}
+		return ErrInsufficientRole
+	}
+	if user.Role != RoleAdmin {
+		if conflict := s.conflictingBooking(e, user); conflict != nil {
+			return fmt.Errorf("'%s' overlaps '%s': %w", e.Title, conflict.Event.Title, ErrTimeConflict)
 		}
 	}
+	if e.Capacity > 0 && s.seatsTaken(e.ID) >= e.Capacity {
+		return fmt.Errorf("cannot book '%s': %w", e.Title, ErrSoldOut)
+	}
+	return nil
+}
+
+func (s *BookingSystem) conflictingBooking(e *Event, user *User) *Booking {
+	for _, b := range s.bookings {
+		if b.User.ID != user.ID || b.Status != StatusActive || b.Event.ID == e.ID {
+			continue
+		}
+		if e.overlaps(b.Event) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *BookingSystem) hasActiveBooking(user *User, eventID int) bool {
+	for _, b := range s.bookings {
+		if b.User.ID == user.ID && b.Event.ID == eventID && b.Status == StatusActive {
+			return true
+		}
+	}
+	return false
+}
+
+// BookableEventsFor treats an event with RequiredRole RoleGuest as open to guests.
+func (s *BookingSystem) BookableEventsFor(user *User) []*Event {
+	now := s.now()
+	var bookable []*Event
+	for _, e := range s.visibleEvents() {
+		if !e.Date.After(now) || s.hasActiveBooking(user, e.ID) {
+			continue
+		}
+		if s.checkEligibility(e, user) == nil {
+			bookable = append(bookable, e)
+		}
+	}
+	return bookable
+}
+
+// EventsByVenue groups events by venue, ignoring case. Each group is keyed by
+// the venue spelling of its first event and sorted by date.
+func (s *BookingSystem) EventsByVenue() map[string][]*Event {
+	keys := make(map[string]string)
+	groups := make(map[string][]*Event)
+	for _, e := range s.visibleEvents() {
+		folded := strings.ToLower(e.Venue)
+		key, ok := keys[folded]
+		if !ok {
+			key = e.Venue
+			keys[folded] = key
+		}
+		groups[key] = append(groups[key], e)
+	}
+	for _, events := range groups {
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Date.Before(events[j].Date) })
+	}
+	return groups
+}
+
+// VenueAvailability maps each future event at the venue (matched
+// case-insensitively) to its free seats. Unlimited-capacity events map to -1.
+func (s *BookingSystem) VenueAvailability(venue string) map[int]int {
+	availability := make(map[int]int)
+	now := s.now()
+	for _, e := range s.visibleEvents() {
+		if !strings.EqualFold(e.Venue, venue) || !e.Date.After(now) {
+			continue
+		}
+		if e.Capacity == 0 {
+			availability[e.ID] = -1
+			continue
+		}
+		availability[e.ID] = max(e.Capacity-s.seatsTaken(e.ID), 0)
+	}
+	return availability
+}
+
+func (s *BookingSystem) BookEvent(userID, eventID int, user *User) error {
+	targetEvent := s.findEvent(eventID)
 	if targetEvent == nil {
-		return fmt.Errorf("event not found")
+		return ErrEventNotFound
+	}
+	if err := s.checkEligibility(targetEvent, user); err != nil {
+		return err
+	}
+	booking := s.createBooking(targetEvent, user)
+	s.audit(user, "book_event", booking.ID)
+	return nil
+}
+
+// BookTickets books qty seats for user in one go; either all seats are
+// booked or none are.
+func (s *BookingSystem) BookTickets(eventID, qty int, user *User) ([]*Booking, error) {
+	if qty <= 0 {
+		return nil, fmt.Errorf("ticket quantity must be positive")
 	}
+	e := s.findEvent(eventID)
+	if e == nil {
+		return nil, ErrEventNotFound
+	}
+	if err := s.checkEligibility(e, user); err != nil {
+		return nil, err
+	}
+	if e.Capacity > 0 && s.seatsTaken(eventID)+qty > e.Capacity {
+		return nil, fmt.Errorf("cannot book %d tickets for '%s': %w", qty, e.Title, ErrSoldOut)
+	}
+	bookings := make([]*Booking, 0, qty)
+	for i := 0; i < qty; i++ {
+		booking := s.createBooking(e, user)
+		s.audit(user, "book_event", booking.ID)
+		bookings = append(bookings, booking)
+	}
+	return bookings, nil
+}
+
+func (s *BookingSystem) createBooking(e *Event, user *User) *Booking {
 	booking := &Booking{
-		ID:     s.nextBookingID,
-		User:   user,
-		Event:  targetEvent,
-		Status: StatusActive,
+		ID:        s.nextBookingID,
+		User:      user,
+		Event:     e,
+		Status:    StatusActive,
+		CreatedAt: s.now(),
+		system:    s,
 	}
 	s.bookings = append(s.bookings, booking)
 	s.nextBookingID++
-	fmt.Printf("Booking created: %s -> %s (ID: %d)\n", user.Name, targetEvent.Title, booking.ID)
+	fmt.Printf("Booking created: %s -> %s (ID: %d)\n", user.Name, e.Title, booking.ID)
+	return booking
+}
+
+func (s *BookingSystem) JoinWaitlist(eventID int, user *User) error {
+	e := s.findEvent(eventID)
+	if e == nil {
+		return ErrEventNotFound
+	}
+	if !e.WaitlistEnabled {
+		return ErrWaitlistDisabled
+	}
+	err := s.checkEligibility(e, user)
+	if err == nil {
+		return ErrSeatsAvailable
+	}
+	if !errors.Is(err, ErrSoldOut) {
+		return err
+	}
+	for _, u := range s.waitlists[eventID] {
+		if u.ID == user.ID {
+			return ErrAlreadyWaitlisted
+		}
+	}
+	s.waitlists[eventID] = append(s.waitlists[eventID], user)
+	s.audit(user, "join_waitlist", eventID)
+	fmt.Printf("%s joined the waitlist for '%s' (position %d)\n", user.Name, e.Title, len(s.waitlists[eventID]))
 	return nil
 }
 
+func (s *BookingSystem) UserWaitlists(user *User) []*Event {
+	var events []*Event
+	for _, e := range s.visibleEvents() {
+		for _, u := range s.waitlists[e.ID] {
+			if u.ID == user.ID {
+				events = append(events, e)
+				break
+			}
+		}
+	}
+	return events
+}
+
+// EstimatedWaitlistClearance returns how many waitlisted users will be
+// promoted before the given user, taking WaitlistPriority into account.
+func (s *BookingSystem) EstimatedWaitlistClearance(eventID int, user *User) (int, error) {
+	if s.findEvent(eventID) == nil {
+		return 0, ErrEventNotFound
+	}
+	waitlist := s.waitlists[eventID]
+	pos := -1
+	for i, u := range waitlist {
+		if u.ID == user.ID {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return 0, ErrNotWaitlisted
+	}
+	if s.WaitlistPriority == nil {
+		return pos, nil
+	}
+	ahead := 0
+	for i, u := range waitlist {
+		if i == pos {
+			continue
+		}
+		if s.WaitlistPriority(u, waitlist[pos]) || (i < pos && !s.WaitlistPriority(waitlist[pos], u)) {
+			ahead++
+		}
+	}
+	return ahead, nil
+}
+
+// promoteWaitlist books waitlisted users while the event has free seats,
+// highest WaitlistPriority first and in join order among equals.
+func (s *BookingSystem) promoteWaitlist(e *Event) {
+	for len(s.waitlists[e.ID]) > 0 {
+		if e.Capacity > 0 && s.seatsTaken(e.ID) >= e.Capacity {
+			return
+		}
+		waitlist := s.waitlists[e.ID]
+		pick := 0
+		if s.WaitlistPriority != nil {
+			for i := 1; i < len(waitlist); i++ {
+				if s.WaitlistPriority(waitlist[i], waitlist[pick]) {
+					pick = i
+				}
+			}
+		}
+		next := waitlist[pick]
+		s.waitlists[e.ID] = append(waitlist[:pick:pick], waitlist[pick+1:]...)
+		booking := s.createBooking(e, next)
+		s.audit(next, "promote_waitlist", booking.ID)
+	}
+}
+
+// FavorFrequentBookers is a WaitlistPriority that promotes users with more
+// past bookings first.
+func (s *BookingSystem) FavorFrequentBookers(a, b *User) bool {
+	return s.bookingCount(a) > s.bookingCount(b)
+}
+
+func (s *BookingSystem) bookingCount(user *User) int {
+	count := 0
+	for _, b := range s.bookings {
+		if b.User != nil && b.User.ID == user.ID {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *BookingSystem) UserTier(user *User) string {
+	count := 0
+	for _, b := range s.bookings {
+		if b.User != nil && b.User.ID == user.ID && b.Status != StatusCancelled {
+			count++
+		}
+	}
+	switch {
+	case count >= s.GoldBookings:
+		return "gold"
+	case count >= s.SilverBookings:
+		return "silver"
+	}
+	return "bronze"
+}
+
+func (s *BookingSystem) cancellable(b *Booking) bool {
+	return s.freeCancellationAt(b, s.now())
+}
+
+func (s *BookingSystem) freeCancellationAt(b *Booking, at time.Time) bool {
+	if at.Sub(b.CreatedAt) <= s.GracePeriod {
+		return true
+	}
+	return s.CancellationDeadline == 0 || b.Event.Date.Sub(at) >= s.CancellationDeadline
+}
+
+// RefundAmount returns what the booking refunds if cancelled now, or what it
+// refunded if it is already cancelled. Late cancellations keep
+// LateCancellationFee (a fraction of the price); events cancelled by the
+// venue are always refunded in full.
+func (s *BookingSystem) RefundAmount(bookingID int) (float64, error) {
+	for _, b := range s.bookings {
+		if b.ID != bookingID {
+			continue
+		}
+		at := s.now()
+		if b.Status == StatusCancelled {
+			at = b.CancelledAt
+		}
+		if b.Event.Deleted || s.freeCancellationAt(b, at) {
+			return b.Event.Price, nil
+		}
+		fee := math.Min(math.Max(s.LateCancellationFee, 0), 1)
+		return b.Event.Price * (1 - fee), nil
+	}
+	return 0, ErrBookingNotFound
+}
+
 func (s *BookingSystem) CancelBooking(bookingID int, user *User) error {
 	for _, b := range s.bookings {
 		if b.ID == bookingID {
 			if b.User.ID != user.ID && user.Role != RoleAdmin {
-				return fmt.Errorf("you can only cancel your own bookings")
+				return ErrNotOwner
+			}
+			if b.Status != StatusActive {
+				return ErrBookingNotActive
+			}
+			if user.Role != RoleAdmin && !s.cancellable(b) {
+				return ErrCancellationClosed
 			}
 			b.Status = StatusCancelled
+			b.CancelledAt = s.now()
+			s.audit(user, "cancel_booking", bookingID)
 			fmt.Printf("Booking ID %d cancelled\n", bookingID)
+			s.promoteWaitlist(b.Event)
 			return nil
 		}
 	}
-	return fmt.Errorf("booking not found")
+	return ErrBookingNotFound
+}
+
+func (s *BookingSystem) UserTotalSpend(user *User) float64 {
+	total := 0.0
+	for _, b := range s.bookings {
+		if b.User.ID == user.ID && b.Status == StatusActive {
+			total += b.Event.Price
+		}
+	}
+	return total
+}
+
+func (s *BookingSystem) OccupancyRate(admin *User) (float64, error) {
+	if admin.Role != RoleAdmin {
+		return 0, fmt.Errorf("cannot view occupancy: %w", ErrNotAdmin)
+	}
+	booked, capacity := 0, 0
+	for _, e := range s.visibleEvents() {
+		if e.Capacity == 0 {
+			continue
+		}
+		booked += s.activeBookingCount(e.ID)
+		capacity += e.Capacity
+	}
+	if capacity == 0 {
+		return 0, nil
+	}
+	return float64(booked) / float64(capacity), nil
+}
+
+func (s *BookingSystem) BookingsForEventTitle(title string, admin *User) ([]*Booking, error) {
+	if admin.Role != RoleAdmin {
+		return nil, fmt.Errorf("cannot search bookings: %w", ErrNotAdmin)
+	}
+	var result []*Booking
+	for _, b := range s.bookings {
+		if b.Status == StatusActive && strings.EqualFold(b.Event.Title, title) {
+			result = append(result, b)
+		}
+	}
+	return result, nil
+}
+
+func (s *BookingSystem) OrphanedBookings() []*Booking {
+	present := make(map[*Event]bool, len(s.events))
+	for _, e := range s.events {
+		present[e] = true
+	}
+	var orphaned []*Booking
+	for _, b := range s.bookings {
+		if !present[b.Event] {
+			orphaned = append(orphaned, b)
+		}
+	}
+	return orphaned
+}
+
+func (s *BookingSystem) TopEvents(n int, admin *User) ([]*Event, error) {
+	if admin.Role != RoleAdmin {
+		return nil, fmt.Errorf("cannot view event statistics: %w", ErrNotAdmin)
+	}
+	events := s.visibleEvents()
+	counts := make(map[int]int, len(events))
+	for _, e := range events {
+		counts[e.ID] = s.activeBookingCount(e.ID)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if counts[events[i].ID] != counts[events[j].ID] {
+			return counts[events[i].ID] > counts[events[j].ID]
+		}
+		return events[i].ID < events[j].ID
+	})
+	if n < len(events) {
+		events = events[:max(n, 0)]
+	}
+	return events, nil
+}
+
+func (s *BookingSystem) AddReview(user *User, eventID int, rating int, text string) error {
+	e := s.findEvent(eventID)
+	if e == nil {
+		return ErrEventNotFound
+	}
+	if rating < 1 || rating > 5 {
+		return fmt.Errorf("rating must be between 1 and 5")
+	}
+	if !e.Date.Before(s.now()) || !s.hasActiveBooking(user, eventID) {
+		return ErrNotAttended
+	}
+	for _, r := range s.reviews {
+		if r.UserID == user.ID && r.EventID == eventID {
+			return fmt.Errorf("user has already reviewed this event")
+		}
+	}
+	s.reviews = append(s.reviews, Review{
+		UserID:    user.ID,
+		EventID:   eventID,
+		Rating:    rating,
+		Text:      text,
+		CreatedAt: s.now(),
+	})
+	s.audit(user, "add_review", eventID)
+	fmt.Printf("Review added for '%s' by %s: %d/5\n", e.Title, user.Name, rating)
+	return nil
+}
+
+// UserActivity returns the user's bookings, cancellations and reviews,
+// oldest first.
+func (s *BookingSystem) UserActivity(user *User) []ActivityEntry {
+	var entries []ActivityEntry
+	for _, b := range s.bookings {
+		if b.User == nil || b.User.ID != user.ID {
+			continue
+		}
+		entries = append(entries, ActivityEntry{
+			At:      b.CreatedAt,
+			Action:  "book",
+			EventID: b.Event.ID,
+			Detail:  fmt.Sprintf("booking %s for '%s'", b.DisplayID(), b.Event.Title),
+		})
+		if b.Status == StatusCancelled {
+			entries = append(entries, ActivityEntry{
+				At:      b.CancelledAt,
+				Action:  "cancel",
+				EventID: b.Event.ID,
+				Detail:  fmt.Sprintf("booking %s for '%s'", b.DisplayID(), b.Event.Title),
+			})
+		}
+	}
+	for _, r := range s.reviews {
+		if r.UserID != user.ID {
+			continue
+		}
+		entries = append(entries, ActivityEntry{
+			At:      r.CreatedAt,
+			Action:  "review",
+			EventID: r.EventID,
+			Detail:  fmt.Sprintf("%d/5 %s", r.Rating, r.Text),
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.Before(entries[j].At) })
+	return entries
+}
+
+func (s *BookingSystem) EventReviews(eventID int) []Review {
+	var reviews []Review
+	for _, r := range s.reviews {
+		if r.EventID == eventID {
+			reviews = append(reviews, r)
+		}
+	}
+	return reviews
+}
+
+func (s *BookingSystem) EventAverageRating(eventID int) float64 {
+	reviews := s.EventReviews(eventID)
+	if len(reviews) == 0 {
+		return 0
+	}
+	sum := 0
+	for _, r := range reviews {
+		sum += r.Rating
+	}
+	return float64(sum) / float64(len(reviews))
+}
+
+func (s *BookingSystem) ReserveSeat(eventID int, user *User, hold time.Duration) (*Reservation, error) {
+	if hold <= 0 {
+		return nil, fmt.Errorf("hold duration must be positive")
+	}
+	e := s.findEvent(eventID)
+	if e == nil {
+		return nil, ErrEventNotFound
+	}
+	if err := s.checkEligibility(e, user); err != nil {
+		return nil, err
+	}
+	r := &Reservation{
+		ID:        s.nextReservationID,
+		User:      user,
+		Event:     e,
+		ExpiresAt: s.now().Add(hold),
+	}
+	s.reservations = append(s.reservations, r)
+	s.nextReservationID++
+	s.audit(user, "reserve_seat", r.ID)
+	fmt.Printf("Seat reserved: %s -> %s until %s (ID: %d)\n", user.Name, e.Title, r.ExpiresAt.Format(dateLayout), r.ID)
+	return r, nil
+}
+
+func (s *BookingSystem) dropReservations(eventID int) {
+	kept := s.reservations[:0]
+	for _, r := range s.reservations {
+		if r.Event.ID != eventID {
+			kept = append(kept, r)
+		}
+	}
+	s.reservations = kept
+}
+
+func (s *BookingSystem) ConfirmReservation(reservationID int) (*Booking, error) {
+	for i, r := range s.reservations {
+		if r.ID != reservationID {
+			continue
+		}
+		s.reservations = append(s.reservations[:i], s.reservations[i+1:]...)
+		if r.Event.Deleted || s.findEvent(r.Event.ID) == nil {
+			return nil, ErrEventNotFound
+		}
+		if !s.now().Before(r.ExpiresAt) {
+			s.promoteWaitlist(r.Event)
+			return nil, ErrReservationExpired
+		}
+		booking := s.createBooking(r.Event, r.User)
+		s.audit(r.User, "confirm_reservation", booking.ID)
+		return booking, nil
+	}
+	return nil, ErrReservationNotFound
+}
+
+// ExpireReservations drops expired reservations, offers the released seats
+// to waitlisted users, and returns how many reservations expired.
+func (s *BookingSystem) ExpireReservations() int {
+	now := s.now()
+	kept := s.reservations[:0]
+	var released []*Event
+	for _, r := range s.reservations {
+		if now.Before(r.ExpiresAt) {
+			kept = append(kept, r)
+			continue
+		}
+		released = append(released, r.Event)
+	}
+	s.reservations = kept
+	for _, e := range released {
+		s.promoteWaitlist(e)
+	}
+	return len(released)
+}
+
+func (s *BookingSystem) CancelBookings(bookingIDs []int, user *User) []error {
+	errs := make([]error, len(bookingIDs))
+	for i, id := range bookingIDs {
+		errs[i] = s.CancelBooking(id, user)
+	}
+	return errs
+}
+
+// Validate checks the system's internal invariants and returns every
+// violation it finds.
+func (s *BookingSystem) Validate() []error {
+	var errs []error
+
+	eventIDs := make(map[int]bool)
+	for _, e := range s.events {
+		if eventIDs[e.ID] {
+			errs = append(errs, fmt.Errorf("duplicate event ID %d", e.ID))
+		}
+		eventIDs[e.ID] = true
+		if e.ID >= s.nextEventID {
+			errs = append(errs, fmt.Errorf("event ID %d not below next event ID %d", e.ID, s.nextEventID))
+		}
+		if e.Capacity > 0 && s.activeBookingCount(e.ID) > e.Capacity {
+			errs = append(errs, fmt.Errorf("event %d has %d active bookings for capacity %d",
+				e.ID, s.activeBookingCount(e.ID), e.Capacity))
+		}
+	}
+
+	userIDs := make(map[int]bool)
+	for _, u := range s.users {
+		if userIDs[u.ID] {
+			errs = append(errs, fmt.Errorf("duplicate user ID %d", u.ID))
+		}
+		userIDs[u.ID] = true
+	}
+
+	bookingIDs := make(map[int]bool)
+	for _, b := range s.bookings {
+		if bookingIDs[b.ID] {
+			errs = append(errs, fmt.Errorf("duplicate booking ID %d", b.ID))
+		}
+		bookingIDs[b.ID] = true
+		if b.ID >= s.nextBookingID {
+			errs = append(errs, fmt.Errorf("booking ID %d not below next booking ID %d", b.ID, s.nextBookingID))
+		}
+		if b.User == nil {
+			errs = append(errs, fmt.Errorf("booking %d has no user", b.ID))
+		} else if !userIDs[b.User.ID] {
+			errs = append(errs, fmt.Errorf("booking %d references unknown user %d", b.ID, b.User.ID))
+		}
+		if b.Event == nil {
+			errs = append(errs, fmt.Errorf("booking %d has no event", b.ID))
+		} else if !eventIDs[b.Event.ID] {
+			errs = append(errs, fmt.Errorf("booking %d references unknown event %d", b.ID, b.Event.ID))
+		}
+	}
+
+	for _, r := range s.reservations {
+		if r.ID >= s.nextReservationID {
+			errs = append(errs, fmt.Errorf("reservation ID %d not below next reservation ID %d", r.ID, s.nextReservationID))
+		}
+	}
+	return errs
 }
 
 func (s *BookingSystem) ListAllBookings(admin *User) {
@@ -168,12 +1458,85 @@ func (s *BookingSystem) ListAllBookings(admin *User) {
 	}
 }
 
+// HandleCommand runs a text command on behalf of actor and returns a
+// human-readable result. Supported commands:
+//
+//	add-event <title> <date "2006-01-02 15:04"> <venue>
+//	delete-event <event-id>
+//	book <event-id>
+//	cancel <booking-id>
+//	list
+func (s *BookingSystem) HandleCommand(cmd string, args []string, actor *User) (string, error) {
+	switch cmd {
+	case "add-event":
+		if len(args) != 3 {
+			return "", fmt.Errorf("usage: add-event <title> <date> <venue>")
+		}
+		date, err := time.ParseInLocation(dateLayout, args[1], time.Local)
+		if err != nil {
+			return "", fmt.Errorf("invalid date %q: %w", args[1], err)
+		}
+		if err := s.AddEvent(args[0], date, args[2], actor); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("event %d added", s.events[len(s.events)-1].ID), nil
+	case "delete-event":
+		id, err := parseIDArg(cmd, args)
+		if err != nil {
+			return "", err
+		}
+		if err := s.DeleteEvent(id, actor); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("event %d deleted", id), nil
+	case "book":
+		id, err := parseIDArg(cmd, args)
+		if err != nil {
+			return "", err
+		}
+		if err := s.BookEvent(actor.ID, id, actor); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("booking %d created", s.bookings[len(s.bookings)-1].ID), nil
+	case "cancel":
+		id, err := parseIDArg(cmd, args)
+		if err != nil {
+			return "", err
+		}
+		if err := s.CancelBooking(id, actor); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("booking %d cancelled", id), nil
+	case "list":
+		if len(s.visibleEvents()) == 0 {
+			return "No events available", nil
+		}
+		return strings.TrimSuffix(s.formatEvents(), "\n"), nil
+	default:
+		return "", fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func parseIDArg(cmd string, args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("usage: %s <id>", cmd)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", args[0])
+	}
+	return id, nil
+}
+
 func main() {
 	system := NewBookingSystem()
 
 	guest := &User{ID: 1, Name: "Anna (guest)", Role: RoleGuest}
 	user := &User{ID: 2, Name: "Ivan (user)", Role: RoleUser}
 	admin := &User{ID: 3, Name: "Olga (admin)", Role: RoleAdmin}
+	for _, u := range []*User{guest, user, admin} {
+		system.RegisterUser(u)
+	}
 
 	system.AddEvent("Jazz Concert", time.Now().Add(24*time.Hour), "Jazz Club", admin)
 	system.AddEvent("Art Exhibition", time.Now().Add(48*time.Hour), "Art Gallery", admin)
@@ -181,6 +1544,11 @@ func main() {
 	fmt.Println("\n--- Guest viewing ---")
 	system.ListEvents()
 
+	fmt.Println("\n--- Guest trying to book ---")
+	if err := system.BookEvent(1, 1, guest); err != nil {
+		fmt.Println("Booking error:", err)
+	}
+
 	fmt.Println("\n--- User booking ---")
 	system.BookEvent(2, 1, user)
 
@@ -0,0 +1,1307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testUsers struct {
+	guest, user, admin *User
+}
+
+func newTestSystem(t *testing.T) (*BookingSystem, testUsers) {
+	t.Helper()
+	s := NewBookingSystem()
+	u := testUsers{
+		guest: &User{ID: 1, Name: "Anna", Role: RoleGuest},
+		user:  &User{ID: 2, Name: "Ivan", Role: RoleUser},
+		admin: &User{ID: 3, Name: "Olga", Role: RoleAdmin},
+	}
+	for _, user := range []*User{u.guest, u.user, u.admin} {
+		if err := s.RegisterUser(user); err != nil {
+			t.Fatalf("RegisterUser: %v", err)
+		}
+	}
+	return s, u
+}
+
+func addTestEvent(t *testing.T, s *BookingSystem, admin *User, title string, in time.Duration) *Event {
+	t.Helper()
+	return addEventAt(t, s, admin, title, time.Now().Add(in), "Jazz Club")
+}
+
+func addEventAt(t *testing.T, s *BookingSystem, admin *User, title string, date time.Time, venue string) *Event {
+	t.Helper()
+	if err := s.AddEvent(title, date, venue, admin); err != nil {
+		t.Fatalf("AddEvent(%q): %v", title, err)
+	}
+	return s.events[len(s.events)-1]
+}
+
+func TestSentinelErrors(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 1
+
+	if err := s.AddEvent("Gig", time.Now().Add(time.Hour), "Club", u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("AddEvent by user: got %v, want ErrNotAdmin", err)
+	}
+	if err := s.DeleteEvent(99, u.admin); !errors.Is(err, ErrEventNotFound) {
+		t.Errorf("DeleteEvent of unknown event: got %v, want ErrEventNotFound", err)
+	}
+	if err := s.BookEvent(u.user.ID, 99, u.user); !errors.Is(err, ErrEventNotFound) {
+		t.Errorf("BookEvent of unknown event: got %v, want ErrEventNotFound", err)
+	}
+	if err := s.BookEvent(u.guest.ID, e.ID, u.guest); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("BookEvent by guest: got %v, want ErrNotRegistered", err)
+	}
+	if err := s.BookEvent(u.user.ID, e.ID, u.user); err != nil {
+		t.Fatalf("BookEvent: %v", err)
+	}
+	if err := s.BookEvent(u.admin.ID, e.ID, u.admin); !errors.Is(err, ErrSoldOut) {
+		t.Errorf("BookEvent of full event: got %v, want ErrSoldOut", err)
+	}
+	if err := s.CancelBooking(99, u.user); !errors.Is(err, ErrBookingNotFound) {
+		t.Errorf("CancelBooking of unknown booking: got %v, want ErrBookingNotFound", err)
+	}
+	other := &User{ID: 4, Name: "Petr", Role: RoleUser}
+	if err := s.CancelBooking(1, other); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("CancelBooking by another user: got %v, want ErrNotOwner", err)
+	}
+	if _, err := s.AuditLog(u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("AuditLog by user: got %v, want ErrNotAdmin", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 1
+	if err := s.BookEvent(u.user.ID, e.ID, u.user); err != nil {
+		t.Fatalf("BookEvent: %v", err)
+	}
+	if err := s.JoinWaitlist(e.ID, u.admin); err != nil {
+		t.Fatalf("JoinWaitlist: %v", err)
+	}
+
+	s.Reset()
+	if len(s.events) != 0 || len(s.users) != 0 || len(s.bookings) != 0 || len(s.waitlists) != 0 || len(s.auditLog) != 0 {
+		t.Errorf("state not cleared: %d events, %d users, %d bookings, %d waitlists, %d audit entries",
+			len(s.events), len(s.users), len(s.bookings), len(s.waitlists), len(s.auditLog))
+	}
+	if s.nextEventID != 1 || s.nextBookingID != 1 || s.nextReservationID != 1 {
+		t.Errorf("counters = %d/%d/%d, want 1/1/1", s.nextEventID, s.nextBookingID, s.nextReservationID)
+	}
+	if e := addTestEvent(t, s, u.admin, "Art Exhibition", 24*time.Hour); e.ID != 1 {
+		t.Errorf("first event after reset has ID %d, want 1", e.ID)
+	}
+}
+
+func TestAddRecurringEvent(t *testing.T) {
+	s, u := newTestSystem(t)
+	first := time.Now().Add(24 * time.Hour)
+	week := 7 * 24 * time.Hour
+	events, err := s.AddRecurringEvent("Yoga", first, "Studio", 4, week, u.admin)
+	if err != nil {
+		t.Fatalf("AddRecurringEvent: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 4", len(events))
+	}
+	for i, e := range events {
+		if i > 0 {
+			if gap := e.Date.Sub(events[i-1].Date); gap != week {
+				t.Errorf("event %d is %v after the previous one, want %v", i, gap, week)
+			}
+			if e.ID == events[i-1].ID {
+				t.Errorf("events %d and %d share ID %d", i-1, i, e.ID)
+			}
+		}
+	}
+
+	for _, interval := range []time.Duration{0, -week} {
+		if _, err := s.AddRecurringEvent("Yoga", first, "Studio", 2, interval, u.admin); err == nil {
+			t.Errorf("AddRecurringEvent with interval %v succeeded, want error", interval)
+		}
+	}
+	if _, err := s.AddRecurringEvent("Yoga", first, "Studio", 0, week, u.admin); err == nil {
+		t.Error("AddRecurringEvent with count 0 succeeded, want error")
+	}
+	if _, err := s.AddRecurringEvent("Yoga", time.Now().Add(-time.Hour), "Studio", 2, week, u.admin); err == nil {
+		t.Error("AddRecurringEvent starting in the past succeeded, want error")
+	}
+}
+
+func TestNextEventAtVenue(t *testing.T) {
+	s, u := newTestSystem(t)
+	now := time.Now()
+	for _, ev := range []struct {
+		title, venue string
+		in           time.Duration
+	}{
+		{"Past Jam", "Jazz Club", -time.Hour},
+		{"Late Show", "Jazz Club", 72 * time.Hour},
+		{"Gallery Night", "Art Gallery", 12 * time.Hour},
+		{"Early Show", "jazz club", 24 * time.Hour},
+	} {
+		if err := s.AddEvent(ev.title, now.Add(ev.in), ev.venue, u.admin); err != nil {
+			t.Fatalf("AddEvent(%q): %v", ev.title, err)
+		}
+	}
+
+	next, err := s.NextEventAtVenue("JAZZ CLUB")
+	if err != nil {
+		t.Fatalf("NextEventAtVenue: %v", err)
+	}
+	if next.Title != "Early Show" {
+		t.Errorf("next event = %q, want %q", next.Title, "Early Show")
+	}
+	if _, err := s.NextEventAtVenue("Opera House"); err == nil {
+		t.Error("NextEventAtVenue for a venue without events succeeded, want error")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	if err := s.BookEvent(u.user.ID, e.ID, u.user); err != nil {
+		t.Fatalf("BookEvent: %v", err)
+	}
+	if err := s.CancelBooking(1, u.user); err != nil {
+		t.Fatalf("CancelBooking: %v", err)
+	}
+	if err := s.DeleteEvent(e.ID, u.admin); err != nil {
+		t.Fatalf("DeleteEvent: %v", err)
+	}
+
+	log, err := s.AuditLog(u.admin)
+	if err != nil {
+		t.Fatalf("AuditLog: %v", err)
+	}
+	want := []AuditEntry{
+		{ActorID: u.admin.ID, Action: "add_event", TargetID: e.ID},
+		{ActorID: u.user.ID, Action: "book_event", TargetID: 1},
+		{ActorID: u.user.ID, Action: "cancel_booking", TargetID: 1},
+		{ActorID: u.admin.ID, Action: "delete_event", TargetID: e.ID},
+	}
+	if len(log) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(log), len(want), log)
+	}
+	for i, entry := range log {
+		if entry.ActorID != want[i].ActorID || entry.Action != want[i].Action || entry.TargetID != want[i].TargetID {
+			t.Errorf("entry %d = %+v, want %+v", i, entry, want[i])
+		}
+		if entry.Timestamp.IsZero() || (i > 0 && entry.Timestamp.Before(log[i-1].Timestamp)) {
+			t.Errorf("entry %d has out-of-order timestamp %v", i, entry.Timestamp)
+		}
+	}
+}
+
+func TestUserTotalSpend(t *testing.T) {
+	s, u := newTestSystem(t)
+	for i, price := range []float64{1500, 700, 300} {
+		e := addTestEvent(t, s, u.admin, "Show", time.Duration(i+1)*24*time.Hour)
+		e.Price = price
+		if err := s.BookEvent(u.user.ID, e.ID, u.user); err != nil {
+			t.Fatalf("BookEvent: %v", err)
+		}
+	}
+	if err := s.CancelBooking(3, u.user); err != nil {
+		t.Fatalf("CancelBooking: %v", err)
+	}
+	if got := s.UserTotalSpend(u.user); got != 2200 {
+		t.Errorf("UserTotalSpend = %.2f, want 2200", got)
+	}
+}
+
+func TestUpdateEventKeepsSettings(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Gala", 24*time.Hour)
+	e.Capacity = 1
+	e.Price = 2500
+	s.BookEvent(u.admin.ID, e.ID, u.admin)
+	if err := s.JoinWaitlist(e.ID, u.user); err != nil {
+		t.Fatalf("JoinWaitlist: %v", err)
+	}
+
+	date := e.Date.Add(time.Hour)
+	if err := s.UpdateEvent(e.ID, "Gala Night", date, "Opera House", u.admin); err != nil {
+		t.Fatalf("UpdateEvent: %v", err)
+	}
+	if e.Title != "Gala Night" || !e.Date.Equal(date) || e.Venue != "Opera House" {
+		t.Errorf("UpdateEvent did not apply the edit: %+v", e)
+	}
+	if e.Capacity != 1 || e.Price != 2500 {
+		t.Errorf("UpdateEvent changed capacity %d or price %.2f", e.Capacity, e.Price)
+	}
+	if got := len(s.waitlists[e.ID]); got != 1 {
+		t.Errorf("%d users waitlisted after UpdateEvent, want 1", got)
+	}
+}
+
+func TestMergeUsers(t *testing.T) {
+	s, u := newTestSystem(t)
+	dup := &User{ID: 4, Name: "Ivan", Role: RoleUser}
+	s.RegisterUser(dup)
+	first := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	second := addTestEvent(t, s, u.admin, "Blues Night", 48*time.Hour)
+	if err := s.BookEvent(u.user.ID, first.ID, u.user); err != nil {
+		t.Fatalf("BookEvent: %v", err)
+	}
+	if err := s.BookEvent(dup.ID, second.ID, dup); err != nil {
+		t.Fatalf("BookEvent: %v", err)
+	}
+
+	if err := s.MergeUsers(u.user.ID, u.user.ID, u.admin); err == nil {
+		t.Error("merging a user into itself succeeded, want error")
+	}
+	if err := s.MergeUsers(u.user.ID, dup.ID, u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("MergeUsers by user: got %v, want ErrNotAdmin", err)
+	}
+	if err := s.MergeUsers(u.user.ID, dup.ID, u.admin); err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+	for _, b := range s.bookings {
+		if b.User != u.user {
+			t.Errorf("booking %d belongs to user %d, want %d", b.ID, b.User.ID, u.user.ID)
+		}
+	}
+	if s.findUser(dup.ID) != nil {
+		t.Error("removed user is still registered")
+	}
+}
+
+func TestRequiredRole(t *testing.T) {
+	s, u := newTestSystem(t)
+	vip := addTestEvent(t, s, u.admin, "Bar Show", 24*time.Hour)
+	vip.RequiredRole = RoleAdmin
+	open := addTestEvent(t, s, u.admin, "Open Air", 48*time.Hour)
+	if open.RequiredRole != RoleUser {
+		t.Errorf("default RequiredRole = %q, want %q", open.RequiredRole, RoleUser)
+	}
+	if err := s.BookEvent(u.user.ID, vip.ID, u.user); !errors.Is(err, ErrInsufficientRole) {
+		t.Errorf("BookEvent of admin-only event: got %v, want ErrInsufficientRole", err)
+	}
+	if err := s.BookEvent(u.user.ID, open.ID, u.user); err != nil {
+		t.Errorf("BookEvent of open event: %v", err)
+	}
+	if err := s.BookEvent(u.admin.ID, vip.ID, u.admin); err != nil {
+		t.Errorf("BookEvent of admin-only event by admin: %v", err)
+	}
+}
+
+func eventTitles(events []*Event) []string {
+	titles := make([]string, len(events))
+	for i, e := range events {
+		titles[i] = e.Title
+	}
+	return titles
+}
+
+func TestBookableEventsFor(t *testing.T) {
+	s, u := newTestSystem(t)
+	addTestEvent(t, s, u.admin, "Past", -time.Hour).RequiredRole = RoleGuest
+	addTestEvent(t, s, u.admin, "Open Day", 24*time.Hour).RequiredRole = RoleGuest
+	addTestEvent(t, s, u.admin, "Concert", 48*time.Hour)
+	addTestEvent(t, s, u.admin, "Board Meeting", 72*time.Hour).RequiredRole = RoleAdmin
+	full := addTestEvent(t, s, u.admin, "Sold Out", 96*time.Hour)
+	full.Capacity = 1
+	booked := addTestEvent(t, s, u.admin, "Booked", 120*time.Hour)
+	if err := s.BookEvent(u.admin.ID, full.ID, u.admin); err != nil {
+		t.Fatalf("BookEvent: %v", err)
+	}
+	if err := s.BookEvent(u.user.ID, booked.ID, u.user); err != nil {
+		t.Fatalf("BookEvent: %v", err)
+	}
+
+	for _, tc := range []struct {
+		user *User
+		want []string
+	}{
+		{u.guest, []string{"Open Day"}},
+		{u.user, []string{"Open Day", "Concert"}},
+	} {
+		got := eventTitles(s.BookableEventsFor(tc.user))
+		if len(got) != len(tc.want) {
+			t.Errorf("BookableEventsFor(%s) = %v, want %v", tc.user.Role, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("BookableEventsFor(%s) = %v, want %v", tc.user.Role, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestCancellationGracePeriod(t *testing.T) {
+	s, u := newTestSystem(t)
+	clock := &fakeClock{t: time.Now()}
+	s.Clock = clock
+	s.CancellationDeadline = 48 * time.Hour
+	s.GracePeriod = 10 * time.Minute
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+
+	s.BookEvent(u.user.ID, e.ID, u.user)
+	clock.Advance(5 * time.Minute)
+	if err := s.CancelBooking(1, u.user); err != nil {
+		t.Errorf("CancelBooking within grace period: %v", err)
+	}
+
+	s.BookEvent(u.user.ID, e.ID, u.user)
+	clock.Advance(20 * time.Minute)
+	if err := s.CancelBooking(2, u.user); !errors.Is(err, ErrCancellationClosed) {
+		t.Errorf("CancelBooking after grace period: got %v, want ErrCancellationClosed", err)
+	}
+}
+
+func TestOccupancyRate(t *testing.T) {
+	s, u := newTestSystem(t)
+	small := addTestEvent(t, s, u.admin, "Small", 24*time.Hour)
+	small.Capacity = 4
+	large := addTestEvent(t, s, u.admin, "Large", 48*time.Hour)
+	large.Capacity = 6
+	unlimited := addTestEvent(t, s, u.admin, "Open Air", 72*time.Hour)
+	if _, err := s.BookTickets(small.ID, 2, u.user); err != nil {
+		t.Fatalf("BookTickets: %v", err)
+	}
+	if _, err := s.BookTickets(large.ID, 1, u.user); err != nil {
+		t.Fatalf("BookTickets: %v", err)
+	}
+	if _, err := s.BookTickets(unlimited.ID, 5, u.user); err != nil {
+		t.Fatalf("BookTickets: %v", err)
+	}
+
+	rate, err := s.OccupancyRate(u.admin)
+	if err != nil {
+		t.Fatalf("OccupancyRate: %v", err)
+	}
+	if rate != 0.3 {
+		t.Errorf("OccupancyRate = %v, want 0.3", rate)
+	}
+	if _, err := s.OccupancyRate(u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("OccupancyRate by user: got %v, want ErrNotAdmin", err)
+	}
+}
+
+func TestWaitlistDisabled(t *testing.T) {
+	s, u := newTestSystem(t)
+	oneOff := addTestEvent(t, s, u.admin, "One-off", 24*time.Hour)
+	oneOff.Capacity = 1
+	oneOff.WaitlistEnabled = false
+	normal := addTestEvent(t, s, u.admin, "Weekly", 48*time.Hour)
+	normal.Capacity = 1
+	for _, e := range []*Event{oneOff, normal} {
+		if err := s.BookEvent(u.admin.ID, e.ID, u.admin); err != nil {
+			t.Fatalf("BookEvent: %v", err)
+		}
+	}
+	if err := s.BookEvent(u.user.ID, oneOff.ID, u.user); !errors.Is(err, ErrSoldOut) {
+		t.Errorf("BookEvent of full event: got %v, want ErrSoldOut", err)
+	}
+	if err := s.JoinWaitlist(oneOff.ID, u.user); !errors.Is(err, ErrWaitlistDisabled) {
+		t.Errorf("JoinWaitlist with waitlist disabled: got %v, want ErrWaitlistDisabled", err)
+	}
+	if err := s.JoinWaitlist(normal.ID, u.user); err != nil {
+		t.Errorf("JoinWaitlist: %v", err)
+	}
+}
+
+func TestMergeUsersMovesWaitlistsAndReviews(t *testing.T) {
+	s, u := newTestSystem(t)
+	dup := &User{ID: 4, Name: "Ivan", Role: RoleUser}
+	other := &User{ID: 5, Name: "Petr", Role: RoleUser}
+	s.RegisterUser(dup)
+	s.RegisterUser(other)
+	full := addTestEvent(t, s, u.admin, "Full", 24*time.Hour)
+	full.Capacity = 1
+	s.BookEvent(u.admin.ID, full.ID, u.admin)
+	for _, user := range []*User{dup, other, u.user} {
+		if err := s.JoinWaitlist(full.ID, user); err != nil {
+			t.Fatalf("JoinWaitlist: %v", err)
+		}
+	}
+	held := addTestEvent(t, s, u.admin, "Held", 48*time.Hour)
+	r, err := s.ReserveSeat(held.ID, dup, time.Hour)
+	if err != nil {
+		t.Fatalf("ReserveSeat: %v", err)
+	}
+	s.reviews = []Review{{UserID: dup.ID, EventID: 7, Rating: 4}, {UserID: u.user.ID, EventID: 8, Rating: 5}, {UserID: dup.ID, EventID: 8, Rating: 1}}
+
+	if err := s.MergeUsers(u.user.ID, dup.ID, u.admin); err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+	waitlist := s.waitlists[full.ID]
+	if len(waitlist) != 2 || waitlist[0] != u.user || waitlist[1] != other {
+		t.Errorf("waitlist after merge = %v, want [Ivan Petr]", waitlist)
+	}
+	if r.User != u.user {
+		t.Errorf("reservation belongs to user %d, want %d", r.User.ID, u.user.ID)
+	}
+	if len(s.reviews) != 2 || s.reviews[0].UserID != u.user.ID || s.reviews[1].Rating != 5 {
+		t.Errorf("reviews after merge = %+v", s.reviews)
+	}
+}
+
+func TestBookingsForEventTitle(t *testing.T) {
+	s, u := newTestSystem(t)
+	first := addTestEvent(t, s, u.admin, "Jazz Night", 24*time.Hour)
+	second := addTestEvent(t, s, u.admin, "jazz night", 48*time.Hour)
+	other := addTestEvent(t, s, u.admin, "Jazz Nights", 72*time.Hour)
+	for _, e := range []*Event{first, second, other} {
+		if err := s.BookEvent(u.user.ID, e.ID, u.user); err != nil {
+			t.Fatalf("BookEvent: %v", err)
+		}
+	}
+	s.BookEvent(u.admin.ID, second.ID, u.admin)
+	s.CancelBooking(4, u.admin)
+
+	bookings, err := s.BookingsForEventTitle("JAZZ NIGHT", u.admin)
+	if err != nil {
+		t.Fatalf("BookingsForEventTitle: %v", err)
+	}
+	if len(bookings) != 2 || bookings[0].Event != first || bookings[1].Event != second {
+		t.Errorf("got %d bookings, want the active ones for events %d and %d", len(bookings), first.ID, second.ID)
+	}
+	if _, err := s.BookingsForEventTitle("Jazz Night", u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("BookingsForEventTitle by user: got %v, want ErrNotAdmin", err)
+	}
+}
+
+func TestAdjustCapacity(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 2
+	s.BookTickets(e.ID, 2, u.admin)
+	if err := s.JoinWaitlist(e.ID, u.user); err != nil {
+		t.Fatalf("JoinWaitlist: %v", err)
+	}
+
+	if err := s.AdjustCapacity(e.ID, 1, u.admin); !errors.Is(err, ErrCapacityTooLow) {
+		t.Errorf("AdjustCapacity below bookings: got %v, want ErrCapacityTooLow", err)
+	}
+	if e.Capacity != 2 {
+		t.Errorf("capacity = %d after rejected decrease, want 2", e.Capacity)
+	}
+	if err := s.AdjustCapacity(e.ID, 3, u.admin); err != nil {
+		t.Fatalf("AdjustCapacity: %v", err)
+	}
+	if !s.hasActiveBooking(u.user, e.ID) {
+		t.Error("waitlisted user was not promoted after the increase")
+	}
+	if len(s.waitlists[e.ID]) != 0 {
+		t.Errorf("waitlist has %d users, want 0", len(s.waitlists[e.ID]))
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	s, u := newTestSystem(t)
+	first := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	first.Capacity = 1
+	addTestEvent(t, s, u.admin, "Art Exhibition", 48*time.Hour)
+	s.BookEvent(u.user.ID, first.ID, u.user)
+	s.JoinWaitlist(first.ID, u.admin)
+
+	path := filepath.Join(t.TempDir(), "system.json")
+	if err := s.SaveToFile(path); err != nil {
+		t.Fatalf("SaveToFile: %v", err)
+	}
+	loaded := NewBookingSystem()
+	if err := loaded.LoadFromFile(path); err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+
+	if len(loaded.events) != 2 || len(loaded.users) != 3 || len(loaded.bookings) != 1 || len(loaded.auditLog) != len(s.auditLog) {
+		t.Errorf("loaded %d events, %d users, %d bookings, %d audit entries",
+			len(loaded.events), len(loaded.users), len(loaded.bookings), len(loaded.auditLog))
+	}
+	if loaded.nextEventID != s.nextEventID || loaded.nextBookingID != s.nextBookingID {
+		t.Errorf("counters = %d/%d, want %d/%d", loaded.nextEventID, loaded.nextBookingID, s.nextEventID, s.nextBookingID)
+	}
+	b := loaded.bookings[0]
+	if b.User != loaded.findUser(u.user.ID) || b.Event != loaded.findEvent(first.ID) {
+		t.Error("loaded booking is not linked to the loaded user and event")
+	}
+	if b.Event.Title != "Jazz Concert" || b.Event.Capacity != 1 || !b.Event.Date.Equal(first.Date) {
+		t.Errorf("loaded event = %+v", b.Event)
+	}
+	if w := loaded.waitlists[first.ID]; len(w) != 1 || w[0] != loaded.findUser(u.admin.ID) {
+		t.Errorf("loaded waitlist = %v", w)
+	}
+}
+
+func TestHandleCommand(t *testing.T) {
+	s, u := newTestSystem(t)
+	date := time.Now().Add(24 * time.Hour).Format(dateLayout)
+	steps := []struct {
+		cmd   string
+		args  []string
+		actor *User
+		want  string
+	}{
+		{"list", nil, u.user, "No events available"},
+		{"add-event", []string{"Jazz Concert", date, "Jazz Club"}, u.admin, "event 1 added"},
+		{"book", []string{"1"}, u.user, "booking 1 created"},
+		{"cancel", []string{"1"}, u.user, "booking 1 cancelled"},
+		{"list", nil, u.user, "ID: 1 | Jazz Concert | " + date + " | Jazz Club"},
+		{"delete-event", []string{"1"}, u.admin, "event 1 deleted"},
+	}
+	for _, step := range steps {
+		got, err := s.HandleCommand(step.cmd, step.args, step.actor)
+		if err != nil {
+			t.Fatalf("%s %v: %v", step.cmd, step.args, err)
+		}
+		if got != step.want {
+			t.Errorf("%s %v = %q, want %q", step.cmd, step.args, got, step.want)
+		}
+	}
+
+	for _, bad := range [][]string{{"book"}, {"book", "x"}, {"fly", "1"}} {
+		if _, err := s.HandleCommand(bad[0], bad[1:], u.user); err == nil {
+			t.Errorf("%v succeeded, want error", bad)
+		}
+	}
+	if _, err := s.HandleCommand("add-event", []string{"Gig", date, "Club"}, u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("add-event by user: got %v, want ErrNotAdmin", err)
+	}
+}
+
+type recordingNotifier struct {
+	messages map[int][]string
+}
+
+func (n *recordingNotifier) Notify(user *User, message string) {
+	if n.messages == nil {
+		n.messages = make(map[int][]string)
+	}
+	n.messages[user.ID] = append(n.messages[user.ID], message)
+}
+
+func TestCancelEventsOnDate(t *testing.T) {
+	s, u := newTestSystem(t)
+	notifier := &recordingNotifier{}
+	s.Notifier = notifier
+	day := time.Now().AddDate(0, 0, 2)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	morning := addEventAt(t, s, u.admin, "Morning", day.Add(9*time.Hour), "Hall")
+	evening := addEventAt(t, s, u.admin, "Evening", day.Add(20*time.Hour), "Hall")
+	nextDay := addEventAt(t, s, u.admin, "Next Day", day.Add(33*time.Hour), "Hall")
+	for _, e := range []*Event{morning, evening, nextDay} {
+		if err := s.BookEvent(u.user.ID, e.ID, u.user); err != nil {
+			t.Fatalf("BookEvent: %v", err)
+		}
+	}
+
+	n, err := s.CancelEventsOnDate(day.Add(12*time.Hour), u.admin)
+	if err != nil {
+		t.Fatalf("CancelEventsOnDate: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("cancelled %d events, want 2", n)
+	}
+	if !morning.Deleted || !evening.Deleted || nextDay.Deleted {
+		t.Errorf("deleted flags = %v/%v/%v, want true/true/false", morning.Deleted, evening.Deleted, nextDay.Deleted)
+	}
+	for _, b := range s.bookings {
+		want := StatusCancelled
+		if b.Event == nextDay {
+			want = StatusActive
+		}
+		if b.Status != want {
+			t.Errorf("booking for %q is %s, want %s", b.Event.Title, b.Status, want)
+		}
+	}
+	if got := len(notifier.messages[u.user.ID]); got != 2 {
+		t.Errorf("user got %d notifications, want 2", got)
+	}
+}
+
+func TestOrphanedBookings(t *testing.T) {
+	s, u := newTestSystem(t)
+	kept := addTestEvent(t, s, u.admin, "Kept", 24*time.Hour)
+	gone := addTestEvent(t, s, u.admin, "Gone", 48*time.Hour)
+	s.BookEvent(u.user.ID, kept.ID, u.user)
+	s.BookEvent(u.user.ID, gone.ID, u.user)
+	if got := s.OrphanedBookings(); len(got) != 0 {
+		t.Fatalf("OrphanedBookings = %d bookings before removal, want 0", len(got))
+	}
+
+	s.events = s.events[:1]
+	orphaned := s.OrphanedBookings()
+	if len(orphaned) != 1 || orphaned[0].Event != gone {
+		t.Errorf("OrphanedBookings = %v, want the booking for %q", orphaned, gone.Title)
+	}
+}
+
+func TestDisplayID(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	s.BookEvent(u.user.ID, e.ID, u.user)
+	b := s.bookings[0]
+	if got := b.DisplayID(); got != "1" {
+		t.Errorf("default DisplayID = %q, want %q", got, "1")
+	}
+	s.BookingIDFormat = func(id int) string { return fmt.Sprintf("BK-2024-%04d", id) }
+	if got := b.DisplayID(); got != "BK-2024-0001" {
+		t.Errorf("DisplayID = %q, want %q", got, "BK-2024-0001")
+	}
+	if b.ID != 1 {
+		t.Errorf("ID = %d, want 1", b.ID)
+	}
+}
+
+func TestTopEvents(t *testing.T) {
+	s, u := newTestSystem(t)
+	var events []*Event
+	for i, count := range []int{3, 1, 2} {
+		e := addTestEvent(t, s, u.admin, fmt.Sprintf("Event %d", i+1), time.Duration(i+1)*24*time.Hour)
+		if _, err := s.BookTickets(e.ID, count, u.user); err != nil {
+			t.Fatalf("BookTickets: %v", err)
+		}
+		events = append(events, e)
+	}
+
+	top, err := s.TopEvents(2, u.admin)
+	if err != nil {
+		t.Fatalf("TopEvents: %v", err)
+	}
+	if len(top) != 2 || top[0] != events[0] || top[1] != events[2] {
+		t.Errorf("TopEvents(2) = %v, want [Event 1 Event 3]", eventTitles(top))
+	}
+	if _, err := s.TopEvents(2, u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("TopEvents by user: got %v, want ErrNotAdmin", err)
+	}
+}
+
+func TestReviews(t *testing.T) {
+	s, u := newTestSystem(t)
+	clock := &fakeClock{t: time.Now()}
+	s.Clock = clock
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", time.Hour)
+	s.BookEvent(u.user.ID, e.ID, u.user)
+	s.BookEvent(u.admin.ID, e.ID, u.admin)
+
+	if err := s.AddReview(u.user, e.ID, 5, "great"); !errors.Is(err, ErrNotAttended) {
+		t.Errorf("AddReview before the event: got %v, want ErrNotAttended", err)
+	}
+	clock.Advance(2 * time.Hour)
+	if err := s.AddReview(u.user, e.ID, 5, "great"); err != nil {
+		t.Fatalf("AddReview: %v", err)
+	}
+	if err := s.AddReview(u.admin, e.ID, 2, "too loud"); err != nil {
+		t.Fatalf("AddReview: %v", err)
+	}
+	if err := s.AddReview(u.guest, e.ID, 4, "never went"); !errors.Is(err, ErrNotAttended) {
+		t.Errorf("AddReview without booking: got %v, want ErrNotAttended", err)
+	}
+	if err := s.AddReview(u.user, e.ID, 4, "again"); err == nil {
+		t.Error("second review by the same user succeeded, want error")
+	}
+	if got := len(s.EventReviews(e.ID)); got != 2 {
+		t.Errorf("EventReviews has %d reviews, want 2", got)
+	}
+	if got := s.EventAverageRating(e.ID); got != 3.5 {
+		t.Errorf("EventAverageRating = %v, want 3.5", got)
+	}
+}
+
+func TestFrozenClock(t *testing.T) {
+	s, u := newTestSystem(t)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{t: now}
+	s.Clock = clock
+	s.CancellationDeadline = 24 * time.Hour
+	past := addEventAt(t, s, u.admin, "Matinee", now.Add(-2*time.Hour), "Hall")
+	soon := addEventAt(t, s, u.admin, "Tonight", now.Add(12*time.Hour), "Hall")
+	later := addEventAt(t, s, u.admin, "Next Week", now.Add(7*24*time.Hour), "Hall")
+
+	if got := eventTitles(s.BookableEventsFor(u.user)); len(got) != 2 || got[0] != "Tonight" {
+		t.Errorf("BookableEventsFor = %v, want [Tonight Next Week]", got)
+	}
+	s.BookEvent(u.user.ID, soon.ID, u.user)
+	s.BookEvent(u.user.ID, later.ID, u.user)
+	if !s.bookings[0].CreatedAt.Equal(now) {
+		t.Errorf("CreatedAt = %v, want %v", s.bookings[0].CreatedAt, now)
+	}
+	clock.Advance(time.Minute)
+	if err := s.CancelBooking(1, u.user); !errors.Is(err, ErrCancellationClosed) {
+		t.Errorf("CancelBooking 12h before the event: got %v, want ErrCancellationClosed", err)
+	}
+	if err := s.CancelBooking(2, u.user); err != nil {
+		t.Errorf("CancelBooking a week before the event: %v", err)
+	}
+	if err := s.AddReview(u.user, past.ID, 5, "lovely"); !errors.Is(err, ErrNotAttended) {
+		t.Errorf("AddReview without a booking: got %v, want ErrNotAttended", err)
+	}
+}
+
+func TestEventsByVenue(t *testing.T) {
+	s, u := newTestSystem(t)
+	now := time.Now()
+	s.AddEvent("Late Jazz", now.Add(72*time.Hour), "Jazz Club", u.admin)
+	s.AddEvent("Sculpture", now.Add(48*time.Hour), "Art Gallery", u.admin)
+	s.AddEvent("Early Jazz", now.Add(24*time.Hour), "JAZZ CLUB", u.admin)
+
+	groups := s.EventsByVenue()
+	if len(groups) != 2 {
+		t.Fatalf("got %d venues, want 2: %v", len(groups), groups)
+	}
+	jazz := eventTitles(groups["Jazz Club"])
+	if len(jazz) != 2 || jazz[0] != "Early Jazz" || jazz[1] != "Late Jazz" {
+		t.Errorf("Jazz Club = %v, want [Early Jazz Late Jazz]", jazz)
+	}
+	if art := eventTitles(groups["Art Gallery"]); len(art) != 1 || art[0] != "Sculpture" {
+		t.Errorf("Art Gallery = %v, want [Sculpture]", art)
+	}
+}
+
+func TestCancelBookings(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	bookings, err := s.BookTickets(e.ID, 3, u.user)
+	if err != nil {
+		t.Fatalf("BookTickets: %v", err)
+	}
+	s.BookEvent(u.admin.ID, e.ID, u.admin)
+
+	errs := s.CancelBookings([]int{bookings[0].ID, 4, bookings[1].ID, 99}, u.user)
+	if len(errs) != 4 {
+		t.Fatalf("got %d errors, want 4", len(errs))
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("own bookings: errors %v and %v, want nil", errs[0], errs[2])
+	}
+	if !errors.Is(errs[1], ErrNotOwner) || !errors.Is(errs[3], ErrBookingNotFound) {
+		t.Errorf("errors = %v, want ErrNotOwner and ErrBookingNotFound", errs)
+	}
+	if bookings[0].Status != StatusCancelled || bookings[1].Status != StatusCancelled || bookings[2].Status != StatusActive {
+		t.Errorf("statuses = %s/%s/%s, want cancelled/cancelled/active", bookings[0].Status, bookings[1].Status, bookings[2].Status)
+	}
+}
+
+func TestUserWaitlists(t *testing.T) {
+	s, u := newTestSystem(t)
+	var events []*Event
+	for i, title := range []string{"First", "Second", "Third"} {
+		e := addTestEvent(t, s, u.admin, title, time.Duration(i+1)*24*time.Hour)
+		e.Capacity = 1
+		s.BookEvent(u.admin.ID, e.ID, u.admin)
+		events = append(events, e)
+	}
+	s.JoinWaitlist(events[2].ID, u.user)
+	s.JoinWaitlist(events[0].ID, u.user)
+
+	got := eventTitles(s.UserWaitlists(u.user))
+	if len(got) != 2 || got[0] != "First" || got[1] != "Third" {
+		t.Errorf("UserWaitlists = %v, want [First Third]", got)
+	}
+	if got := s.UserWaitlists(u.guest); len(got) != 0 {
+		t.Errorf("UserWaitlists for guest = %v, want none", eventTitles(got))
+	}
+}
+
+func TestReserveSeat(t *testing.T) {
+	s, u := newTestSystem(t)
+	clock := &fakeClock{t: time.Now()}
+	s.Clock = clock
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 1
+
+	r, err := s.ReserveSeat(e.ID, u.user, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveSeat: %v", err)
+	}
+	if err := s.BookEvent(u.admin.ID, e.ID, u.admin); !errors.Is(err, ErrSoldOut) {
+		t.Errorf("BookEvent while the seat is held: got %v, want ErrSoldOut", err)
+	}
+	clock.Advance(5 * time.Minute)
+	b, err := s.ConfirmReservation(r.ID)
+	if err != nil {
+		t.Fatalf("ConfirmReservation: %v", err)
+	}
+	if b.User != u.user || b.Event != e || b.Status != StatusActive {
+		t.Errorf("confirmed booking = %+v", b)
+	}
+	if _, err := s.ConfirmReservation(r.ID); !errors.Is(err, ErrReservationNotFound) {
+		t.Errorf("second ConfirmReservation: got %v, want ErrReservationNotFound", err)
+	}
+}
+
+func TestReservationExpires(t *testing.T) {
+	s, u := newTestSystem(t)
+	clock := &fakeClock{t: time.Now()}
+	s.Clock = clock
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 1
+	r, _ := s.ReserveSeat(e.ID, u.user, 10*time.Minute)
+
+	clock.Advance(11 * time.Minute)
+	if n := s.ExpireReservations(); n != 1 {
+		t.Errorf("ExpireReservations = %d, want 1", n)
+	}
+	if _, err := s.ConfirmReservation(r.ID); !errors.Is(err, ErrReservationNotFound) {
+		t.Errorf("ConfirmReservation after expiry: got %v, want ErrReservationNotFound", err)
+	}
+	if err := s.BookEvent(u.admin.ID, e.ID, u.admin); err != nil {
+		t.Errorf("BookEvent after the hold expired: %v", err)
+	}
+}
+
+func TestReservationsOnRemovedEvents(t *testing.T) {
+	s, u := newTestSystem(t)
+	deleted := addTestEvent(t, s, u.admin, "Deleted", 24*time.Hour)
+	cancelled := addTestEvent(t, s, u.admin, "Cancelled", 48*time.Hour)
+	kept := addTestEvent(t, s, u.admin, "Kept", 72*time.Hour)
+	r1, _ := s.ReserveSeat(deleted.ID, u.user, time.Hour)
+	r2, _ := s.ReserveSeat(cancelled.ID, u.user, time.Hour)
+	r3, _ := s.ReserveSeat(kept.ID, u.user, time.Hour)
+
+	s.DeleteEvent(deleted.ID, u.admin)
+	s.CancelEventsOnDate(cancelled.Date, u.admin)
+	for _, r := range []*Reservation{r1, r2} {
+		if _, err := s.ConfirmReservation(r.ID); err == nil {
+			t.Errorf("ConfirmReservation for %q succeeded, want error", r.Event.Title)
+		}
+	}
+	if len(s.reservations) != 1 || s.reservations[0] != r3 {
+		t.Errorf("reservations left = %d, want only the one for %q", len(s.reservations), kept.Title)
+	}
+}
+
+func TestSaveLoadReservationsAndReviews(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	r, _ := s.ReserveSeat(e.ID, u.user, time.Hour)
+	s.reviews = []Review{{UserID: u.user.ID, EventID: e.ID, Rating: 4, Text: "good"}}
+
+	path := filepath.Join(t.TempDir(), "system.json")
+	if err := s.SaveToFile(path); err != nil {
+		t.Fatalf("SaveToFile: %v", err)
+	}
+	loaded := NewBookingSystem()
+	loaded.reviews = []Review{{UserID: 9, EventID: 9, Rating: 1}}
+	if err := loaded.LoadFromFile(path); err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+
+	if len(loaded.reservations) != 1 {
+		t.Fatalf("loaded %d reservations, want 1", len(loaded.reservations))
+	}
+	lr := loaded.reservations[0]
+	if lr.ID != r.ID || lr.User != loaded.findUser(u.user.ID) || lr.Event != loaded.findEvent(e.ID) || !lr.ExpiresAt.Equal(r.ExpiresAt) {
+		t.Errorf("loaded reservation = %+v", lr)
+	}
+	if loaded.nextReservationID != s.nextReservationID {
+		t.Errorf("nextReservationID = %d, want %d", loaded.nextReservationID, s.nextReservationID)
+	}
+	if len(loaded.reviews) != 1 || loaded.reviews[0].Text != "good" {
+		t.Errorf("loaded reviews = %+v", loaded.reviews)
+	}
+}
+
+func TestRefundAmount(t *testing.T) {
+	s, u := newTestSystem(t)
+	clock := &fakeClock{t: time.Now()}
+	s.Clock = clock
+	s.CancellationDeadline = 24 * time.Hour
+	s.LateCancellationFee = 0.25
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 72*time.Hour)
+	e.Price = 1000
+	s.BookEvent(u.user.ID, e.ID, u.user)
+	s.BookEvent(u.user.ID, e.ID, u.user)
+
+	clock.Advance(time.Hour)
+	if got, _ := s.RefundAmount(1); got != 1000 {
+		t.Errorf("refund outside the window = %.2f, want 1000", got)
+	}
+	s.CancelBooking(1, u.user)
+	clock.Advance(60 * time.Hour)
+	if got, _ := s.RefundAmount(1); got != 1000 {
+		t.Errorf("refund of an early cancellation = %.2f, want 1000", got)
+	}
+	if got, _ := s.RefundAmount(2); got != 750 {
+		t.Errorf("refund inside the window = %.2f, want 750", got)
+	}
+	if _, err := s.RefundAmount(99); !errors.Is(err, ErrBookingNotFound) {
+		t.Errorf("RefundAmount of unknown booking: got %v, want ErrBookingNotFound", err)
+	}
+}
+
+func TestCancelBookingTwice(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 72*time.Hour)
+	s.BookEvent(u.user.ID, e.ID, u.user)
+	if err := s.CancelBooking(1, u.user); err != nil {
+		t.Fatalf("CancelBooking: %v", err)
+	}
+	cancelledAt := s.bookings[0].CancelledAt
+	if err := s.CancelBooking(1, u.admin); !errors.Is(err, ErrBookingNotActive) {
+		t.Errorf("second CancelBooking: got %v, want ErrBookingNotActive", err)
+	}
+	if !s.bookings[0].CancelledAt.Equal(cancelledAt) {
+		t.Error("second CancelBooking changed CancelledAt")
+	}
+}
+
+func TestTimeConflict(t *testing.T) {
+	s, u := newTestSystem(t)
+	start := time.Now().Add(24 * time.Hour)
+	concert := addEventAt(t, s, u.admin, "Concert", start, "Hall")
+	concert.Duration = 2 * time.Hour
+	overlapping := addEventAt(t, s, u.admin, "Talk", start.Add(time.Hour), "Annex")
+	overlapping.Duration = time.Hour
+	after := addEventAt(t, s, u.admin, "Party", start.Add(2*time.Hour), "Bar")
+	after.Duration = time.Hour
+
+	if err := s.BookEvent(u.user.ID, concert.ID, u.user); err != nil {
+		t.Fatalf("BookEvent: %v", err)
+	}
+	if err := s.BookEvent(u.user.ID, overlapping.ID, u.user); !errors.Is(err, ErrTimeConflict) {
+		t.Errorf("BookEvent of overlapping event: got %v, want ErrTimeConflict", err)
+	}
+	if err := s.BookEvent(u.user.ID, after.ID, u.user); err != nil {
+		t.Errorf("BookEvent of back-to-back event: %v", err)
+	}
+	s.BookEvent(u.admin.ID, concert.ID, u.admin)
+	if err := s.BookEvent(u.admin.ID, overlapping.ID, u.admin); err != nil {
+		t.Errorf("admin BookEvent of overlapping event: %v", err)
+	}
+}
+
+func errorStrings(errs []error) []string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return msgs
+}
+
+func TestValidate(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 1
+	addTestEvent(t, s, u.admin, "Art Exhibition", 48*time.Hour)
+	s.BookEvent(u.user.ID, e.ID, u.user)
+	if errs := s.Validate(); len(errs) != 0 {
+		t.Fatalf("Validate on a consistent system = %q", errorStrings(errs))
+	}
+
+	s.events[1].ID = e.ID
+	s.bookings = append(s.bookings, &Booking{ID: 2, User: &User{ID: 42}, Event: e, Status: StatusActive})
+	got := errorStrings(s.Validate())
+	want := []string{
+		"event 1 has 2 active bookings for capacity 1",
+		"duplicate event ID 1",
+		"booking ID 2 not below next booking ID 2",
+		"booking 2 references unknown user 42",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Validate = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("violation %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWaitlistPriority(t *testing.T) {
+	s, u := newTestSystem(t)
+	loyal := &User{ID: 5, Name: "Petr", Role: RoleUser}
+	s.RegisterUser(loyal)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 1
+	s.BookEvent(u.admin.ID, e.ID, u.admin)
+	s.JoinWaitlist(e.ID, u.user)
+	s.JoinWaitlist(e.ID, loyal)
+
+	s.WaitlistPriority = func(a, b *User) bool { return a.ID == loyal.ID && b.ID != loyal.ID }
+	if err := s.CancelBooking(1, u.admin); err != nil {
+		t.Fatalf("CancelBooking: %v", err)
+	}
+	if !s.hasActiveBooking(loyal, e.ID) || s.hasActiveBooking(u.user, e.ID) {
+		t.Error("the higher-priority user was not promoted ahead of the earlier joiner")
+	}
+	if w := s.waitlists[e.ID]; len(w) != 1 || w[0] != u.user {
+		t.Errorf("waitlist = %v, want only %s", w, u.user.Name)
+	}
+}
+
+func TestFavorFrequentBookers(t *testing.T) {
+	s, u := newTestSystem(t)
+	regular := &User{ID: 5, Name: "Petr", Role: RoleUser}
+	s.RegisterUser(regular)
+	past := addTestEvent(t, s, u.admin, "Earlier", 12*time.Hour)
+	s.BookTickets(past.ID, 2, regular)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 1
+	s.BookEvent(u.admin.ID, e.ID, u.admin)
+	s.JoinWaitlist(e.ID, u.user)
+	s.JoinWaitlist(e.ID, regular)
+	s.WaitlistPriority = s.FavorFrequentBookers
+
+	s.CancelBooking(3, u.admin)
+	if !s.hasActiveBooking(regular, e.ID) {
+		t.Error("the more frequent booker was not promoted first")
+	}
+}
+
+func TestIsSoldOut(t *testing.T) {
+	s, u := newTestSystem(t)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 2
+	unlimited := addTestEvent(t, s, u.admin, "Open Air", 48*time.Hour)
+	s.BookTickets(e.ID, 2, u.user)
+	s.BookTickets(unlimited.ID, 5, u.user)
+
+	if soldOut, err := s.IsSoldOut(e.ID); err != nil || !soldOut {
+		t.Errorf("IsSoldOut at capacity = %v, %v; want true", soldOut, err)
+	}
+	if soldOut, _ := s.IsSoldOut(unlimited.ID); soldOut {
+		t.Error("IsSoldOut for an unlimited event = true, want false")
+	}
+	s.CancelBooking(1, u.user)
+	if soldOut, _ := s.IsSoldOut(e.ID); soldOut {
+		t.Error("IsSoldOut after a cancellation = true, want false")
+	}
+	if _, err := s.IsSoldOut(99); err == nil {
+		t.Error("IsSoldOut for an unknown event succeeded, want error")
+	}
+}
+
+func TestPurgeCancelledBefore(t *testing.T) {
+	s, u := newTestSystem(t)
+	now := time.Now()
+	old := addTestEvent(t, s, u.admin, "Old", time.Hour)
+	recent := addTestEvent(t, s, u.admin, "Recent", 10*24*time.Hour)
+	s.BookEvent(u.user.ID, old.ID, u.user)
+	s.BookEvent(u.user.ID, recent.ID, u.user)
+	s.BookEvent(u.admin.ID, old.ID, u.admin)
+	s.CancelBookings([]int{1, 2}, u.user)
+
+	if _, err := s.PurgeCancelledBefore(now.Add(48*time.Hour), u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("PurgeCancelledBefore by user: got %v, want ErrNotAdmin", err)
+	}
+	n, err := s.PurgeCancelledBefore(now.Add(48*time.Hour), u.admin)
+	if err != nil {
+		t.Fatalf("PurgeCancelledBefore: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("purged %d bookings, want 1", n)
+	}
+	if len(s.bookings) != 2 || s.bookings[0].ID != 2 || s.bookings[1].ID != 3 {
+		t.Errorf("%d bookings left, want the recent cancelled one and the active one", len(s.bookings))
+	}
+}
+
+func TestExportEventsCSV(t *testing.T) {
+	s, u := newTestSystem(t)
+	date := time.Date(2030, 5, 1, 19, 30, 0, 0, time.UTC)
+	addEventAt(t, s, u.admin, "Jazz Concert", date, "Club, Main Hall").Capacity = 50
+	s.AddEvent(`Say "Cheese"`, date.Add(24*time.Hour), "Gallery", u.admin)
+
+	data, err := s.ExportEventsCSV()
+	if err != nil {
+		t.Fatalf("ExportEventsCSV: %v", err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatalf("parsing export: %v\n%s", err, data)
+	}
+	want := [][]string{
+		{"id", "title", "date", "venue", "capacity"},
+		{"1", "Jazz Concert", "2030-05-01T19:30:00Z", "Club, Main Hall", "50"},
+		{"2", `Say "Cheese"`, "2030-05-02T19:30:00Z", "Gallery", "0"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d:\n%s", len(records), len(want), data)
+	}
+	for i := range want {
+		for j := range want[i] {
+			if records[i][j] != want[i][j] {
+				t.Errorf("record %d field %d = %q, want %q", i, j, records[i][j], want[i][j])
+			}
+		}
+	}
+}
+
+func TestBroadcastToEvent(t *testing.T) {
+	s, u := newTestSystem(t)
+	notifier := &recordingNotifier{}
+	s.Notifier = notifier
+	dropped := &User{ID: 5, Name: "Petr", Role: RoleUser}
+	s.RegisterUser(dropped)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	s.BookTickets(e.ID, 2, u.user)
+	s.BookEvent(u.admin.ID, e.ID, u.admin)
+	s.BookEvent(dropped.ID, e.ID, dropped)
+	s.CancelBooking(4, dropped)
+
+	if _, err := s.BroadcastToEvent(e.ID, "doors open at 7", u.user); !errors.Is(err, ErrNotAdmin) {
+		t.Errorf("BroadcastToEvent by user: got %v, want ErrNotAdmin", err)
+	}
+	n, err := s.BroadcastToEvent(e.ID, "doors open at 7", u.admin)
+	if err != nil {
+		t.Fatalf("BroadcastToEvent: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("notified %d users, want 2", n)
+	}
+	for _, user := range []*User{u.user, u.admin} {
+		if msgs := notifier.messages[user.ID]; len(msgs) != 1 || msgs[0] != "doors open at 7" {
+			t.Errorf("%s got %q, want one broadcast", user.Name, msgs)
+		}
+	}
+	if msgs := notifier.messages[dropped.ID]; len(msgs) != 0 {
+		t.Errorf("user with a cancelled booking got %q", msgs)
+	}
+}
+
+func TestEstimatedWaitlistClearance(t *testing.T) {
+	s, u := newTestSystem(t)
+	petr := &User{ID: 5, Name: "Petr", Role: RoleUser}
+	s.RegisterUser(petr)
+	sofia := &User{ID: 6, Name: "Sofia", Role: RoleUser}
+	s.RegisterUser(sofia)
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	e.Capacity = 1
+	s.BookEvent(sofia.ID, e.ID, sofia)
+	waiting := []*User{u.user, petr, u.admin}
+	for _, user := range waiting {
+		if err := s.JoinWaitlist(e.ID, user); err != nil {
+			t.Fatalf("JoinWaitlist(%s): %v", user.Name, err)
+		}
+	}
+
+	for want, user := range waiting {
+		got, err := s.EstimatedWaitlistClearance(e.ID, user)
+		if err != nil || got != want {
+			t.Errorf("EstimatedWaitlistClearance(%s) = %d, %v; want %d", user.Name, got, err, want)
+		}
+	}
+	if _, err := s.EstimatedWaitlistClearance(e.ID, u.guest); !errors.Is(err, ErrNotWaitlisted) {
+		t.Errorf("EstimatedWaitlistClearance for a user not waiting: got %v, want ErrNotWaitlisted", err)
+	}
+
+	s.WaitlistPriority = func(a, b *User) bool { return a.ID == petr.ID && b.ID != petr.ID }
+	if got, _ := s.EstimatedWaitlistClearance(e.ID, petr); got != 0 {
+		t.Errorf("with priority, %s has %d ahead, want 0", petr.Name, got)
+	}
+	if got, _ := s.EstimatedWaitlistClearance(e.ID, u.user); got != 1 {
+		t.Errorf("with priority, %s has %d ahead, want 1", u.user.Name, got)
+	}
+}
+
+func TestUserActivity(t *testing.T) {
+	s, u := newTestSystem(t)
+	clock := &fakeClock{t: time.Now()}
+	s.Clock = clock
+	first := addTestEvent(t, s, u.admin, "First", 24*time.Hour)
+	second := addTestEvent(t, s, u.admin, "Second", time.Hour)
+	s.BookEvent(u.user.ID, first.ID, u.user)
+	clock.Advance(time.Minute)
+	s.BookEvent(u.user.ID, second.ID, u.user)
+	clock.Advance(time.Minute)
+	s.CancelBooking(1, u.user)
+	clock.Advance(2 * time.Hour)
+	if err := s.AddReview(u.user, second.ID, 4, "nice"); err != nil {
+		t.Fatalf("AddReview: %v", err)
+	}
+	s.BookEvent(u.admin.ID, first.ID, u.admin)
+
+	activity := s.UserActivity(u.user)
+	want := []struct {
+		action  string
+		eventID int
+	}{
+		{"book", first.ID},
+		{"book", second.ID},
+		{"cancel", first.ID},
+		{"review", second.ID},
+	}
+	if len(activity) != len(want) {
+		t.Fatalf("UserActivity = %+v, want %d entries", activity, len(want))
+	}
+	for i, w := range want {
+		if activity[i].Action != w.action || activity[i].EventID != w.eventID {
+			t.Errorf("entry %d = %s on event %d, want %s on event %d", i, activity[i].Action, activity[i].EventID, w.action, w.eventID)
+		}
+		if i > 0 && activity[i].At.Before(activity[i-1].At) {
+			t.Errorf("entry %d is out of order", i)
+		}
+	}
+}
+
+func TestBlackoutDates(t *testing.T) {
+	s, u := newTestSystem(t)
+	day := time.Now().AddDate(0, 0, 3)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	s.BlackoutDates = map[string][]time.Time{"Jazz Club": {day}}
+
+	if err := s.AddEvent("Gig", day.Add(20*time.Hour), "jazz club", u.admin); !errors.Is(err, ErrVenueUnavailable) {
+		t.Errorf("AddEvent on a blackout day: got %v, want ErrVenueUnavailable", err)
+	}
+	e := addEventAt(t, s, u.admin, "Gig", day.Add(44*time.Hour), "Jazz Club")
+	if err := s.AddEvent("Show", day.Add(20*time.Hour), "Art Gallery", u.admin); err != nil {
+		t.Errorf("AddEvent at another venue: %v", err)
+	}
+	if err := s.UpdateEvent(e.ID, "Gig", day.Add(9*time.Hour), "JAZZ CLUB", u.admin); !errors.Is(err, ErrVenueUnavailable) {
+		t.Errorf("UpdateEvent onto a blackout day: got %v, want ErrVenueUnavailable", err)
+	}
+	if _, err := s.AddRecurringEvent("Weekly", day.Add(-4*time.Hour), "Jazz Club", 2, 24*time.Hour, u.admin); !errors.Is(err, ErrVenueUnavailable) {
+		t.Errorf("AddRecurringEvent across a blackout day: got %v, want ErrVenueUnavailable", err)
+	}
+}
+
+func TestUserTier(t *testing.T) {
+	s, u := newTestSystem(t)
+	s.SilverBookings = 2
+	s.GoldBookings = 4
+	e := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	for i, want := range []string{"bronze", "silver", "silver", "gold"} {
+		s.BookEvent(u.user.ID, e.ID, u.user)
+		if got := s.UserTier(u.user); got != want {
+			t.Errorf("after %d bookings: tier %q, want %q", i+1, got, want)
+		}
+	}
+	s.CancelBooking(4, u.user)
+	if got := s.UserTier(u.user); got != "silver" {
+		t.Errorf("after a cancellation: tier %q, want silver", got)
+	}
+}
+
+func TestVenueAvailability(t *testing.T) {
+	s, u := newTestSystem(t)
+	full := addTestEvent(t, s, u.admin, "Jazz Concert", 24*time.Hour)
+	full.Capacity = 1
+	partial := addTestEvent(t, s, u.admin, "Blues Night", 48*time.Hour)
+	partial.Capacity = 3
+	open := addTestEvent(t, s, u.admin, "Open Mic", 72*time.Hour)
+	s.AddEvent("Matinee", time.Now().Add(-time.Hour), "Jazz Club", u.admin)
+	s.AddEvent("Gig", time.Now().Add(time.Hour), "Rock Bar", u.admin)
+	s.BookEvent(u.user.ID, full.ID, u.user)
+	s.BookEvent(u.user.ID, partial.ID, u.user)
+
+	got := s.VenueAvailability("jazz club")
+	want := map[int]int{full.ID: 0, partial.ID: 2, open.ID: -1}
+	if len(got) != len(want) {
+		t.Fatalf("VenueAvailability = %v, want %v", got, want)
+	}
+	for id, seats := range want {
+		if got[id] != seats {
+			t.Errorf("event %d: %d seats left, want %d", id, got[id], seats)
+		}
+	}
+}
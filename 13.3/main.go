@@ -1,14 +1,41 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	ErrEmptyCart           = errors.New("cart is empty")
+	ErrOrderCancelled      = errors.New("order cancelled")
+	ErrPaymentFailed       = errors.New("payment failed")
+	ErrPaymentNotConfirmed = errors.New("payment not confirmed")
+	ErrInsufficientStock   = errors.New("insufficient stock")
+	ErrOrderNotFound       = errors.New("order not found")
+	ErrSplitMismatch       = errors.New("split payment amounts do not match total")
+	ErrInvalidQuantity     = errors.New("invalid quantity")
+	ErrQuantityExceedsMax  = errors.New("quantity exceeds per-item maximum")
+	ErrItemNotInCart       = errors.New("product not in cart")
+	ErrAddressRequired     = errors.New("shipping address required")
+	ErrNotShipped          = errors.New("order not shipped")
+	ErrNotRefundable       = errors.New("order cannot be refunded")
+	ErrInvalidPromo        = errors.New("invalid promo code")
+	ErrNotAuthorized       = errors.New("payment not authorized")
+	ErrNoShippedOrders     = errors.New("no shipped orders")
 )
 
 type Product struct {
-	ID    int
-	Name  string
-	Price float64
+	ID       int
+	Name     string
+	Price    float64
+	Category string
 }
 
 type Cart struct {
@@ -18,10 +45,82 @@ type Cart struct {
 type CartItem struct {
 	Product  Product
 	Quantity int
+	Note     string
+	Bundle   *Bundle
+}
+
+// Bundle is sold as a single line priced at Price, regardless of what its
+// component products would cost on their own.
+type Bundle struct {
+	ID       int
+	Name     string
+	Products []Product
+	Price    float64
+}
+
+func (c *Cart) AddProduct(p Product, qty int) error {
+	return c.addItem(CartItem{Product: p, Quantity: qty})
+}
+
+func (c *Cart) AddCustomProduct(p Product, qty int, note string) error {
+	return c.addItem(CartItem{Product: p, Quantity: qty, Note: note})
+}
+
+// AddBundle adds a bundle line. The line's Product carries the bundle's ID,
+// which is not a product ID, so product lookups skip bundle lines.
+func (c *Cart) AddBundle(b Bundle, qty int) error {
+	b.Products = append([]Product(nil), b.Products...)
+	return c.addItem(CartItem{
+		Product:  Product{ID: b.ID, Name: b.Name, Price: b.Price},
+		Quantity: qty,
+		Bundle:   &b,
+	})
+}
+
+// clone copies the item so that its bundle is not shared with the original.
+func (item CartItem) clone() CartItem {
+	if item.Bundle != nil {
+		b := *item.Bundle
+		b.Products = append([]Product(nil), b.Products...)
+		item.Bundle = &b
+	}
+	return item
+}
+
+// addItem is the single entry point for new cart lines, so no line can be
+// added with a zero or negative quantity.
+func (c *Cart) addItem(item CartItem) error {
+	if item.Quantity <= 0 {
+		return ErrInvalidQuantity
+	}
+	c.Items = append(c.Items, item)
+	return nil
+}
+
+// checkQuantities catches lines whose quantity was set directly on Items.
+func (c *Cart) checkQuantities() error {
+	for _, item := range c.Items {
+		if item.Quantity <= 0 {
+			return fmt.Errorf("%s: %w", item.Product.Name, ErrInvalidQuantity)
+		}
+	}
+	return nil
 }
 
-func (c *Cart) AddProduct(p Product, qty int) {
-	c.Items = append(c.Items, CartItem{Product: p, Quantity: qty})
+// unitsByProduct counts the physical units per product ID, expanding bundles
+// into their components.
+func (c *Cart) unitsByProduct() map[int]int {
+	units := make(map[int]int)
+	for _, item := range c.Items {
+		if item.Bundle == nil {
+			units[item.Product.ID] += item.Quantity
+			continue
+		}
+		for _, p := range item.Bundle.Products {
+			units[p.ID] += item.Quantity
+		}
+	}
+	return units
 }
 
 func (c *Cart) GetTotal() float64 {
@@ -32,6 +131,45 @@ func (c *Cart) GetTotal() float64 {
 	return total
 }
 
+// GetTotalExcluding previews the total without the given product's lines.
+func (c *Cart) GetTotalExcluding(productID int) float64 {
+	total := 0.0
+	for _, item := range c.Items {
+		if item.Bundle != nil || item.Product.ID != productID {
+			total += item.Product.Price * float64(item.Quantity)
+		}
+	}
+	return total
+}
+
+// Split partitions the cart's items into physical and digital carts so they
+// can be ordered and delivered separately.
+func (c *Cart) Split(isDigital func(Product) bool) (physical, digital *Cart) {
+	physical, digital = &Cart{}, &Cart{}
+	for _, item := range c.Items {
+		if isDigital(item.Product) {
+			digital.Items = append(digital.Items, item)
+		} else {
+			physical.Items = append(physical.Items, item)
+		}
+	}
+	return physical, digital
+}
+
+func (c *Cart) AveragePrice(productID int) (float64, error) {
+	units, spent := 0, 0.0
+	for _, item := range c.Items {
+		if item.Bundle == nil && item.Product.ID == productID {
+			units += item.Quantity
+			spent += item.Product.Price * float64(item.Quantity)
+		}
+	}
+	if units == 0 {
+		return 0, ErrItemNotInCart
+	}
+	return spent / float64(units), nil
+}
+
 type PaymentMethod string
 
 const (
@@ -40,20 +178,167 @@ const (
 	PaymentCash   PaymentMethod = "cash_on_delivery"
 )
 
+type OrderNote struct {
+	Author   string
+	Text     string
+	Internal bool // hidden from the customer
+	At       time.Time
+}
+
+type PaymentPart struct {
+	Method PaymentMethod
+	Amount float64
+}
+
+type OrderStatus string
+
+const (
+	StatusCreated    OrderStatus = "created"
+	StatusAuthorized OrderStatus = "authorized"
+	StatusPaid       OrderStatus = "paid"
+	StatusShipped    OrderStatus = "shipped"
+	StatusCancelled  OrderStatus = "cancelled"
+	StatusRefunded   OrderStatus = "refunded"
+)
+
+var statusTransitions = map[OrderStatus]map[string]OrderStatus{
+	StatusCreated: {
+		"pay":       StatusPaid,
+		"authorize": StatusAuthorized,
+		"cancel":    StatusCancelled,
+	},
+	StatusAuthorized: {
+		"capture": StatusPaid,
+		"cancel":  StatusCancelled,
+	},
+	StatusPaid: {
+		"ship":   StatusShipped,
+		"refund": StatusRefunded,
+	},
+	StatusShipped: {
+		"refund": StatusRefunded,
+	},
+	StatusCancelled: {},
+	StatusRefunded:  {},
+}
+
+// advance applies action to the order's status through statusTransitions,
+// so every status change is one the table allows.
+func advance(order *Order, action string) error {
+	next, ok := statusTransitions[order.Status][action]
+	if !ok {
+		return fmt.Errorf("cannot %s order in status %s", action, order.Status)
+	}
+	order.Status = next
+	return nil
+}
+
+func canAdvance(order *Order, action string) bool {
+	_, ok := statusTransitions[order.Status][action]
+	return ok
+}
+
+func ExportStatusDOT() string {
+	statuses := make([]OrderStatus, 0, len(statusTransitions))
+	for status := range statusTransitions {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i] < statuses[j] })
+
+	var sb strings.Builder
+	sb.WriteString("digraph Order {\n")
+	for _, status := range statuses {
+		if len(statusTransitions[status]) == 0 {
+			fmt.Fprintf(&sb, "  %q [shape=doublecircle];\n", status)
+		} else {
+			fmt.Fprintf(&sb, "  %q [shape=circle];\n", status)
+		}
+	}
+	for _, from := range statuses {
+		actions := make([]string, 0, len(statusTransitions[from]))
+		for action := range statusTransitions[from] {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+		for _, action := range actions {
+			fmt.Fprintf(&sb, "  %q -> %q [label=%q];\n", from, statusTransitions[from][action], action)
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+type Tier struct {
+	MinTotal        float64
+	DiscountPercent float64
+}
+
+// Break prices every unit of a line at UnitPrice once the line reaches
+// MinQuantity units.
+type Break struct {
+	MinQuantity int
+	UnitPrice   float64
+}
+
+type DiscountType string
+
+const (
+	DiscountTypePercent DiscountType = "percent"
+	DiscountTypeFixed   DiscountType = "fixed"
+)
+
 type PromoCode struct {
 	Code            string
+	DiscountType    DiscountType // empty means percent
 	DiscountPercent float64
+	DiscountAmount  float64
+	AppliesTo       []int // product IDs; empty means the whole order
+}
+
+func (p *PromoCode) valid() bool {
+	if p == nil || p.Code == "" {
+		return false
+	}
+	switch p.DiscountType {
+	case DiscountTypeFixed:
+		return p.DiscountAmount > 0
+	case DiscountTypePercent, "":
+		return p.DiscountPercent > 0 && p.DiscountPercent <= 100
+	}
+	return false
 }
 
 type Order struct {
-	ID            int
-	CustomerName  string
-	Address       string
-	Cart          Cart
-	PaymentMethod PaymentMethod
-	TotalAmount   float64
-	Status        string
-	Cancelled     bool
+	ID             int
+	CustomerName   string
+	Address        string
+	Cart           Cart
+	PaymentMethod  PaymentMethod
+	TotalAmount    float64
+	Promo          *PromoCode
+	TierDiscount   float64
+	Tax            float64
+	CreditApplied  float64
+	Status         OrderStatus
+	TrackingNumber string
+	InvoiceNumber  string
+	Digital        bool
+	CreatedAt      time.Time
+	ShippedAt      time.Time
+	Notes          []OrderNote
+	Cancelled      bool
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+type Notifier interface {
+	Notify(msg string)
 }
 
 type NotificationService struct{}
@@ -62,84 +347,916 @@ func (ns *NotificationService) Notify(msg string) {
 	fmt.Printf("Notification: %s\n", msg)
 }
 
+// BatchNotifier buffers messages until Flush, which is useful for bulk
+// operations that would otherwise interleave their output.
+type BatchNotifier struct {
+	messages []string
+}
+
+func (bn *BatchNotifier) Notify(msg string) {
+	bn.messages = append(bn.messages, msg)
+}
+
+func (bn *BatchNotifier) Flush() []string {
+	messages := bn.messages
+	bn.messages = nil
+	return messages
+}
+
 type OrderProcessor struct {
-	NextOrderID int
-	Notifier    *NotificationService
+	NextOrderID       int
+	Notifier          Notifier
+	PaymentAttempts   int
+	PaymentRetryDelay time.Duration
+	MaxQtyPerItem     int // 0 means unlimited
+	OnShip            func(*Order)
+	DeliveryDays      int
+	DiscountTiers     []Tier
+	StackTierAndPromo bool
+	DryRun            bool // Pay only reports the total, without charging or changing state
+	Clock             Clock
+	RepriceStaleItems bool // RevalidateCart updates stale prices instead of only warning
+	LowStockThreshold int
+	OnLowStock        func(productID, remaining int)
+	Templates         map[string]string        // text/template bodies keyed by event name, executed with the *Order
+	QuantityBreaks    map[int][]Break          // keyed by product ID
+	TaxRates          map[string]float64       // keyed by product category, e.g. 0.2 for 20%
+	DefaultTaxRate    float64                  // for categories missing from TaxRates
+	UseStoreCredit    bool                     // Pay and Authorize draw on the customer's store credit first
+	Gateway           func(PaymentMethod) bool // reports whether a charge went through; nil always succeeds
+	orders            []*Order
+	stock             map[int]int
+	loyalty           map[string]int
+	credits           map[string]float64
+	nextInvoice       int
 }
 
+// One loyalty point is awarded per this much spent.
+const loyaltySpendPerPoint = 100
+
 func NewOrderProcessor() *OrderProcessor {
 	return &OrderProcessor{
-		NextOrderID: 1,
-		Notifier:    &NotificationService{},
+		NextOrderID:     1,
+		Notifier:        &NotificationService{},
+		PaymentAttempts: 1,
+		Clock:           realClock{},
+		orders:          make([]*Order, 0),
+		stock:           make(map[int]int),
+		loyalty:         make(map[string]int),
+		credits:         make(map[string]float64),
 	}
 }
 
+func (op *OrderProcessor) now() time.Time {
+	if op.Clock == nil {
+		return time.Now()
+	}
+	return op.Clock.Now()
+}
+
+func (op *OrderProcessor) SetStock(productID, qty int) {
+	op.stock[productID] = qty
+}
+
+// Products without a stock entry are treated as unlimited.
+func (op *OrderProcessor) checkStock(cart *Cart) error {
+	for id, qty := range cart.unitsByProduct() {
+		available, tracked := op.stock[id]
+		if tracked && available < qty {
+			return fmt.Errorf("product %d: %w", id, ErrInsufficientStock)
+		}
+	}
+	return nil
+}
+
+// InventoryValue prices the remaining stock of every tracked product found in
+// the catalog.
+func (op *OrderProcessor) InventoryValue(catalog map[int]Product) float64 {
+	value := 0.0
+	for id, qty := range op.stock {
+		if p, ok := catalog[id]; ok && qty > 0 {
+			value += p.Price * float64(qty)
+		}
+	}
+	return value
+}
+
+func (op *OrderProcessor) findOrder(orderID int) *Order {
+	for _, o := range op.orders {
+		if o.ID == orderID {
+			return o
+		}
+	}
+	return nil
+}
+
+func (op *OrderProcessor) GetOrder(orderID int) (*Order, error) {
+	order := op.findOrder(orderID)
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	return order, nil
+}
+
+func (op *OrderProcessor) FindByInvoice(number string) (*Order, error) {
+	for _, o := range op.orders {
+		if number != "" && o.InvoiceNumber == number {
+			return o, nil
+		}
+	}
+	return nil, ErrOrderNotFound
+}
+
+// ImportOrdersJSON appends orders from a JSON array to the order history.
+// Orders without an ID get a fresh one; provided IDs are kept and
+// NextOrderID is advanced past them, as is the invoice counter past any
+// imported invoice numbers. An empty status means created, and Cancelled
+// follows the status. Nothing is imported on error.
+func (op *OrderProcessor) ImportOrdersJSON(data []byte) (int, error) {
+	var imported []*Order
+	if err := json.Unmarshal(data, &imported); err != nil {
+		return 0, fmt.Errorf("import orders: %w", err)
+	}
+	seen := make(map[int]bool)
+	for _, order := range imported {
+		if order == nil {
+			return 0, errors.New("import orders: null order")
+		}
+		if err := order.Cart.checkQuantities(); err != nil {
+			return 0, fmt.Errorf("import orders: order %d: %w", order.ID, err)
+		}
+		if _, known := statusTransitions[order.Status]; order.Status != "" && !known {
+			return 0, fmt.Errorf("import orders: order %d: unknown status %q", order.ID, order.Status)
+		}
+		if order.ID == 0 {
+			continue
+		}
+		if seen[order.ID] || op.findOrder(order.ID) != nil {
+			return 0, fmt.Errorf("import orders: duplicate order ID %d", order.ID)
+		}
+		seen[order.ID] = true
+	}
+	for _, order := range imported {
+		if order.ID >= op.NextOrderID {
+			op.NextOrderID = order.ID + 1
+		}
+	}
+	for _, order := range imported {
+		if order.ID == 0 {
+			order.ID = op.NextOrderID
+			op.NextOrderID++
+		}
+		if order.Status == "" {
+			order.Status = StatusCreated
+		}
+		order.Cancelled = order.Status == StatusCancelled
+		op.nextInvoice = max(op.nextInvoice, invoiceSeq(order.InvoiceNumber))
+		op.orders = append(op.orders, order)
+	}
+	return len(imported), nil
+}
+
+// invoiceSeq returns the sequence number of an INV-NNNNN invoice number, or 0
+// if number is not in that form.
+func invoiceSeq(number string) int {
+	var seq int
+	if _, err := fmt.Sscanf(number, "INV-%d", &seq); err != nil {
+		return 0
+	}
+	return seq
+}
+
 func (op *OrderProcessor) CreateCart() *Cart {
 	return &Cart{}
 }
 
-func (op *OrderProcessor) CreateOrder(cart *Cart, name, address string, paymentMethod PaymentMethod) *Order {
+func (op *OrderProcessor) validateQuantity(qty int) error {
+	if qty <= 0 {
+		return ErrInvalidQuantity
+	}
+	if op.MaxQtyPerItem > 0 && qty > op.MaxQtyPerItem {
+		return ErrQuantityExceedsMax
+	}
+	return nil
+}
+
+func (op *OrderProcessor) AddToCart(cart *Cart, p Product, qty int) error {
+	if err := op.validateQuantity(qty); err != nil {
+		return err
+	}
+	return cart.AddProduct(p, qty)
+}
+
+func (op *OrderProcessor) UpdateQuantity(cart *Cart, productID, qty int) error {
+	if err := op.validateQuantity(qty); err != nil {
+		return err
+	}
+	for i := range cart.Items {
+		if cart.Items[i].Bundle == nil && cart.Items[i].Product.ID == productID {
+			cart.Items[i].Quantity = qty
+			return nil
+		}
+	}
+	return ErrItemNotInCart
+}
+
+func (op *OrderProcessor) RevalidateCart(cart *Cart, catalog map[int]Product) []string {
+	var warnings []string
+	for i := range cart.Items {
+		item := &cart.Items[i]
+		if item.Bundle != nil {
+			continue
+		}
+		current, ok := catalog[item.Product.ID]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("%s is no longer in the catalog", item.Product.Name))
+			continue
+		}
+		if current.Price == item.Product.Price {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("%s price changed from %.2f to %.2f",
+			item.Product.Name, item.Product.Price, current.Price))
+		if op.RepriceStaleItems {
+			item.Product.Price = current.Price
+		}
+	}
+	return warnings
+}
+
+func (op *OrderProcessor) CreateOrder(cart *Cart, name, address string, paymentMethod PaymentMethod) (*Order, error) {
 	if len(cart.Items) == 0 {
-		panic("Cart is empty")
+		return nil, ErrEmptyCart
+	}
+	if err := cart.checkQuantities(); err != nil {
+		return nil, err
+	}
+	items := make([]CartItem, len(cart.Items))
+	for i, item := range cart.Items {
+		items[i] = item.clone()
 	}
 	order := &Order{
 		ID:            op.NextOrderID,
 		CustomerName:  name,
 		Address:       address,
-		Cart:          *cart,
+		Cart:          Cart{Items: items},
 		PaymentMethod: paymentMethod,
-		Status:        "created",
+		Status:        StatusCreated,
+		CreatedAt:     op.now(),
 		Cancelled:     false,
 	}
 	op.NextOrderID++
-	return order
+	op.orders = append(op.orders, order)
+	return order, nil
+}
+
+func (op *OrderProcessor) Reorder(previousOrderID int, name, address string, method PaymentMethod) (*Order, error) {
+	previous := op.findOrder(previousOrderID)
+	if previous == nil {
+		return nil, ErrOrderNotFound
+	}
+	cart := op.CreateCart()
+	cart.Items = append(cart.Items, previous.Cart.Items...)
+	if err := op.checkStock(cart); err != nil {
+		return nil, err
+	}
+	return op.CreateOrder(cart, name, address, method)
+}
+
+// Checkout creates, pays and ships an order in one call. On failure the
+// order is returned alongside the error in whatever state it reached.
+func (op *OrderProcessor) Checkout(cart *Cart, name, address string, method PaymentMethod, promo *PromoCode) (*Order, error) {
+	order, err := op.CreateOrder(cart, name, address, method)
+	if err != nil {
+		return nil, err
+	}
+	if err := op.Pay(order, promo); err != nil {
+		return order, err
+	}
+	if err := op.ProcessAndShip(order); err != nil {
+		return order, err
+	}
+	return order, nil
 }
 
 func (op *OrderProcessor) Pay(order *Order, promo *PromoCode) error {
+	return op.PayContext(context.Background(), order, promo)
+}
+
+func (op *OrderProcessor) PayContext(ctx context.Context, order *Order, promo *PromoCode) error {
+	if err := payable(order); err != nil {
+		return err
+	}
+	if op.DryRun {
+		return op.previewPayment(order, promo)
+	}
+	total, err := op.authorizeAmount(ctx, order, promo)
+	if err != nil {
+		return err
+	}
+	return op.completePayment(order, "pay", total)
+}
+
+// payable rejects orders that Pay must not charge: cancelled ones, and any
+// that are already authorized or paid. Authorized orders go through Capture.
+func payable(order *Order) error {
 	if order.Cancelled {
-		return errors.New("order cancelled")
+		return ErrOrderCancelled
 	}
+	if !canAdvance(order, "pay") {
+		return fmt.Errorf("cannot pay order in status %s", order.Status)
+	}
+	return nil
+}
 
-	if !op.simulatePayment(order.PaymentMethod) {
-		return errors.New("payment failed")
+func (op *OrderProcessor) previewPayment(order *Order, promo *PromoCode) error {
+	if order.Cancelled {
+		return ErrOrderCancelled
+	}
+	if err := op.checkStock(&order.Cart); err != nil {
+		return err
 	}
+	q := op.priceOrder(order, promo)
+	op.Notifier.Notify(fmt.Sprintf("Dry run for order #%d: subtotal %.2f, discounts %.2f, tax %.2f, total %.2f",
+		order.ID, q.Subtotal, q.PromoDiscount+q.TierDiscount, q.Tax, q.Total))
+	return nil
+}
 
-	total := order.Cart.GetTotal()
+func (op *OrderProcessor) Authorize(order *Order, promo *PromoCode) error {
+	if !order.Cancelled && !canAdvance(order, "authorize") {
+		return fmt.Errorf("cannot authorize order in status %s", order.Status)
+	}
+	total, err := op.authorizeAmount(context.Background(), order, promo)
+	if err != nil {
+		return err
+	}
+	if err := advance(order, "authorize"); err != nil {
+		return err
+	}
+	order.TotalAmount = total
+	op.notifyEvent("authorized", order, fmt.Sprintf("Payment authorized. Amount held: %.2f", total))
+	return nil
+}
+
+// Capture settles an authorized order. Stock is not reserved at
+// authorization, so it is checked again here.
+func (op *OrderProcessor) Capture(order *Order) error {
+	if !canAdvance(order, "capture") {
+		return ErrNotAuthorized
+	}
+	if err := op.checkStock(&order.Cart); err != nil {
+		return err
+	}
+	return op.completePayment(order, "capture", order.TotalAmount)
+}
+
+// authorizeAmount validates the order, charges the payment method and
+// returns the amount it was charged after any promo and store credit. The
+// payment method is not charged when store credit covers the whole total.
+func (op *OrderProcessor) authorizeAmount(ctx context.Context, order *Order, promo *PromoCode) (float64, error) {
+	if order.Cancelled {
+		return 0, ErrOrderCancelled
+	}
+
+	if err := op.checkStock(&order.Cart); err != nil {
+		return 0, err
+	}
+
+	q := op.priceOrder(order, promo)
+	credit := op.creditFor(order, q.Total)
+	due := q.Total - credit
+
+	if due > 0 {
+		if err := op.charge(ctx, order.PaymentMethod); err != nil {
+			return 0, err
+		}
+	}
+
+	op.recordDiscounts(order, q)
+	op.applyCredit(order, credit)
+	return due, nil
+}
+
+// creditFor returns how much of total the customer's store credit covers,
+// or 0 when UseStoreCredit is off.
+func (op *OrderProcessor) creditFor(order *Order, total float64) float64 {
+	if !op.UseStoreCredit {
+		return 0
+	}
+	return math.Min(op.credits[order.CustomerName], total)
+}
+
+func (op *OrderProcessor) applyCredit(order *Order, credit float64) {
+	if credit <= 0 {
+		return
+	}
+	op.credits[order.CustomerName] -= credit
+	order.CreditApplied = credit
+	op.Notifier.Notify(fmt.Sprintf("Store credit applied: %.2f", credit))
+}
+
+type priceQuote struct {
+	Subtotal      float64
+	Promo         *PromoCode
+	PromoDiscount float64
+	TierDiscount  float64
+	Tax           float64
+	Total         float64
+}
+
+// priceOrder computes what the order would cost with the given promo (or the
+// order's attached promo if nil) and the best matching discount tier. Unless
+// StackTierAndPromo is set, only the larger of the two discounts applies.
+// Tax is added on top of the discounted amount.
+func (op *OrderProcessor) priceOrder(order *Order, promo *PromoCode) priceQuote {
+	if promo == nil {
+		promo = order.Promo
+	}
+	q := priceQuote{Subtotal: op.subtotal(&order.Cart), Promo: promo}
 	if promo != nil {
-		discount := total * (promo.DiscountPercent / 100)
-		total -= discount
-		op.Notifier.Notify(fmt.Sprintf("Promo code %s applied. Discount: %.2f", promo.Code, discount))
+		q.PromoDiscount = promoDiscount(op.promoBase(&order.Cart, promo), promo)
+	}
+	q.TierDiscount = q.Subtotal * (op.bestTierPercent(q.Subtotal) / 100)
+	if !op.StackTierAndPromo {
+		if q.TierDiscount > q.PromoDiscount {
+			q.PromoDiscount = 0
+		} else {
+			q.TierDiscount = 0
+		}
+	}
+	q.Total = math.Max(q.Subtotal-q.PromoDiscount-q.TierDiscount, 0)
+	if q.Subtotal > 0 {
+		q.Tax = op.tax(&order.Cart) * q.Total / q.Subtotal
+	}
+	q.Total += q.Tax
+	return q
+}
+
+// subtotal is the cart total with quantity breaks applied per line.
+func (op *OrderProcessor) subtotal(cart *Cart) float64 {
+	total := 0.0
+	for _, item := range cart.Items {
+		total += op.unitPrice(item) * float64(item.Quantity)
+	}
+	return total
+}
+
+// unitPrice picks the cheapest break the line qualifies for, falling back to
+// the product's list price.
+func (op *OrderProcessor) unitPrice(item CartItem) float64 {
+	price := item.Product.Price
+	if item.Bundle != nil {
+		return price
+	}
+	for _, b := range op.QuantityBreaks[item.Product.ID] {
+		if item.Quantity >= b.MinQuantity && b.UnitPrice < price {
+			price = b.UnitPrice
+		}
+	}
+	return price
+}
+
+// tax sums each line's tax at its category rate, before discounts.
+func (op *OrderProcessor) tax(cart *Cart) float64 {
+	total := 0.0
+	for _, item := range cart.Items {
+		rate, ok := op.TaxRates[item.Product.Category]
+		if !ok {
+			rate = op.DefaultTaxRate
+		}
+		total += op.unitPrice(item) * float64(item.Quantity) * rate
+	}
+	return total
+}
+
+func (op *OrderProcessor) bestTierPercent(subtotal float64) float64 {
+	best := 0.0
+	for _, tier := range op.DiscountTiers {
+		if subtotal >= tier.MinTotal && tier.DiscountPercent > best {
+			best = tier.DiscountPercent
+		}
+	}
+	return best
+}
+
+func (op *OrderProcessor) recordDiscounts(order *Order, q priceQuote) {
+	order.TierDiscount = q.TierDiscount
+	order.Tax = q.Tax
+	if q.TierDiscount > 0 {
+		op.Notifier.Notify(fmt.Sprintf("Volume discount applied: %.2f", q.TierDiscount))
+	}
+	if q.PromoDiscount > 0 {
+		op.Notifier.Notify(fmt.Sprintf("Promo code %s applied. Discount: %.2f", q.Promo.Code, q.PromoDiscount))
+	}
+}
+
+// promoBase is the part of the subtotal the promo can discount.
+func (op *OrderProcessor) promoBase(cart *Cart, promo *PromoCode) float64 {
+	if len(promo.AppliesTo) == 0 {
+		return op.subtotal(cart)
+	}
+	eligible := make(map[int]bool, len(promo.AppliesTo))
+	for _, id := range promo.AppliesTo {
+		eligible[id] = true
+	}
+	base := 0.0
+	for _, item := range cart.Items {
+		if item.Bundle == nil && eligible[item.Product.ID] {
+			base += op.unitPrice(item) * float64(item.Quantity)
+		}
+	}
+	return base
+}
+
+// promoDiscount never exceeds the subtotal, so a fixed discount cannot make
+// the total negative.
+func promoDiscount(subtotal float64, promo *PromoCode) float64 {
+	if promo.DiscountType == DiscountTypeFixed {
+		return math.Min(promo.DiscountAmount, subtotal)
+	}
+	return subtotal * (promo.DiscountPercent / 100)
+}
+
+func (op *OrderProcessor) ApplyPromo(order *Order, promo *PromoCode) error {
+	if order.Cancelled {
+		return ErrOrderCancelled
+	}
+	if order.Status != StatusCreated {
+		return fmt.Errorf("promo can only be applied before payment")
+	}
+	if !promo.valid() {
+		return ErrInvalidPromo
+	}
+	order.Promo = promo
+	op.Notifier.Notify(fmt.Sprintf("Promo code %s attached to order #%d", promo.Code, order.ID))
+	return nil
+}
+
+// PromoHelps reports whether the promo lowers the order total compared to no
+// promo at all, and the total it would give. Discount tiers apply to both.
+func (op *OrderProcessor) PromoHelps(order *Order, promo *PromoCode) (bool, float64, error) {
+	if order.Cancelled {
+		return false, 0, ErrOrderCancelled
+	}
+	if !promo.valid() {
+		return false, 0, ErrInvalidPromo
+	}
+	bare := *order
+	bare.Promo = nil
+	without := op.priceOrder(&bare, nil)
+	with := op.priceOrder(&bare, promo)
+	return with.Total < without.Total, with.Total, nil
+}
+
+// PaySplit pays the order with several methods at once; with UseStoreCredit
+// the parts cover what is left after store credit. Parts are charged in
+// order; if one fails, the parts already charged are not voided and have to
+// be reversed with the payment provider.
+func (op *OrderProcessor) PaySplit(order *Order, parts []PaymentPart) error {
+	if err := payable(order); err != nil {
+		return err
+	}
+	for i, part := range parts {
+		if part.Amount <= 0 {
+			return fmt.Errorf("split payment part %d: amount must be positive", i+1)
+		}
+	}
+
+	if err := op.checkStock(&order.Cart); err != nil {
+		return err
+	}
+
+	q := op.priceOrder(order, nil)
+	credit := op.creditFor(order, q.Total)
+	due := q.Total - credit
+	sum := 0.0
+	for _, part := range parts {
+		sum += part.Amount
+	}
+	if math.Abs(sum-due) > 0.005 {
+		return ErrSplitMismatch
+	}
+
+	for _, part := range parts {
+		if err := op.charge(context.Background(), part.Method); err != nil {
+			return err
+		}
+	}
+
+	op.recordDiscounts(order, q)
+	op.applyCredit(order, credit)
+	return op.completePayment(order, "pay", due)
+}
+
+// completePayment moves the order to paid via action ("pay" or "capture")
+// and settles stock, loyalty and the invoice.
+func (op *OrderProcessor) completePayment(order *Order, action string, total float64) error {
+	if err := advance(order, action); err != nil {
+		return err
+	}
+	for id, qty := range order.Cart.unitsByProduct() {
+		if _, tracked := op.stock[id]; !tracked {
+			continue
+		}
+		op.stock[id] -= qty
+		if op.OnLowStock != nil && op.stock[id] <= op.LowStockThreshold {
+			op.OnLowStock(id, op.stock[id])
+		}
 	}
 
 	order.TotalAmount = total
-	order.Status = "paid"
-	op.Notifier.Notify(fmt.Sprintf("Payment successful. Total: %.2f", total))
+	if order.InvoiceNumber == "" {
+		op.nextInvoice++
+		order.InvoiceNumber = fmt.Sprintf("INV-%05d", op.nextInvoice)
+	}
+	op.loyalty[order.CustomerName] += loyaltyPointsFor(total)
+	op.notifyEvent("paid", order, fmt.Sprintf("Payment successful. Total: %.2f", total))
 	return nil
 }
 
+func loyaltyPointsFor(amount float64) int {
+	return int(amount / loyaltySpendPerPoint)
+}
+
+func (op *OrderProcessor) LoyaltyPoints(customer string) int {
+	return op.loyalty[customer]
+}
+
+func (op *OrderProcessor) AddStoreCredit(customer string, amount float64) error {
+	if amount <= 0 {
+		return errors.New("credit amount must be positive")
+	}
+	op.credits[customer] += amount
+	return nil
+}
+
+func (op *OrderProcessor) StoreCredit(customer string) float64 {
+	return op.credits[customer]
+}
+
+// Refund reverses a paid or shipped order: the units go back into stock and
+// the loyalty points it earned are taken back.
+func (op *OrderProcessor) Refund(order *Order) error {
+	if !canAdvance(order, "refund") {
+		return ErrNotRefundable
+	}
+	if err := advance(order, "refund"); err != nil {
+		return err
+	}
+	op.restoreCredit(order)
+	for id, qty := range order.Cart.unitsByProduct() {
+		if _, tracked := op.stock[id]; tracked {
+			op.stock[id] += qty
+		}
+	}
+	op.loyalty[order.CustomerName] -= loyaltyPointsFor(order.TotalAmount)
+	if op.loyalty[order.CustomerName] < 0 {
+		op.loyalty[order.CustomerName] = 0
+	}
+	op.notifyEvent("refunded", order, fmt.Sprintf("Order #%d refunded: %.2f", order.ID, order.TotalAmount))
+	return nil
+}
+
+// charge retries the payment up to PaymentAttempts times, giving up early
+// if ctx is cancelled before or between attempts.
+func (op *OrderProcessor) charge(ctx context.Context, method PaymentMethod) error {
+	attempts := op.PaymentAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(op.PaymentRetryDelay):
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if op.simulatePayment(method) {
+			return nil
+		}
+	}
+	return ErrPaymentFailed
+}
+
 func (op *OrderProcessor) simulatePayment(method PaymentMethod) bool {
 	fmt.Printf("Processing payment via %s...\n", method)
+	if op.Gateway != nil {
+		return op.Gateway(method)
+	}
 	return true
 }
 
 func (op *OrderProcessor) ProcessAndShip(order *Order) error {
-	if order.Status != "paid" {
-		return errors.New("payment not confirmed")
+	if !canAdvance(order, "ship") {
+		return ErrPaymentNotConfirmed
+	}
+	if order.Digital {
+		op.notifyEvent("delivered", order, fmt.Sprintf("Order #%d delivered digitally", order.ID))
+	} else {
+		if strings.TrimSpace(order.Address) == "" {
+			return ErrAddressRequired
+		}
+		op.notifyEvent("processing", order, "Order is being processed at the warehouse")
+		order.TrackingNumber = fmt.Sprintf("TRK-%06d", order.ID)
+		op.notifyEvent("shipped", order, fmt.Sprintf("Order #%d shipped to address: %s", order.ID, order.Address))
+	}
+	if err := advance(order, "ship"); err != nil {
+		return err
+	}
+	order.ShippedAt = op.now()
+	if op.OnShip != nil {
+		op.OnShip(order)
 	}
-	op.Notifier.Notify("Order is being processed at the warehouse")
-	op.Notifier.Notify(fmt.Sprintf("Order #%d shipped to address: %s", order.ID, order.Address))
-	order.Status = "shipped"
 	return nil
 }
 
-func (op *OrderProcessor) CancelOrder(order *Order) {
-	if order.Status == "paid" || order.Status == "shipped" {
-		fmt.Println("Cannot cancel paid order")
-		return
+func (op *OrderProcessor) ProcessAndShipBatch(orders []*Order) []error {
+	errs := make([]error, len(orders))
+	for i, order := range orders {
+		errs[i] = op.ProcessAndShip(order)
+	}
+	return errs
+}
+
+func (op *OrderProcessor) EstimatedDelivery(order *Order) (time.Time, error) {
+	if order.Status != StatusShipped {
+		return time.Time{}, ErrNotShipped
+	}
+	return order.ShippedAt.AddDate(0, 0, op.DeliveryDays), nil
+}
+
+type ProductSales struct {
+	ProductID int
+	Name      string
+	Units     int
+}
+
+// TopProducts ranks products by units sold across paid and shipped orders,
+// counting bundle components individually. Ties are broken by product ID.
+func (op *OrderProcessor) TopProducts(n int) []ProductSales {
+	sales := make(map[int]*ProductSales)
+	add := func(p Product, qty int) {
+		if sales[p.ID] == nil {
+			sales[p.ID] = &ProductSales{ProductID: p.ID, Name: p.Name}
+		}
+		sales[p.ID].Units += qty
+	}
+	for _, order := range op.orders {
+		if order.Status != StatusPaid && order.Status != StatusShipped {
+			continue
+		}
+		for _, item := range order.Cart.Items {
+			if item.Bundle == nil {
+				add(item.Product, item.Quantity)
+				continue
+			}
+			for _, p := range item.Bundle.Products {
+				add(p, item.Quantity)
+			}
+		}
+	}
+	ranked := make([]ProductSales, 0, len(sales))
+	for _, ps := range sales {
+		ranked = append(ranked, *ps)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Units != ranked[j].Units {
+			return ranked[i].Units > ranked[j].Units
+		}
+		return ranked[i].ProductID < ranked[j].ProductID
+	})
+	if n >= 0 && n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// AverageFulfillmentTime is the mean time from creation to shipment over all
+// shipped orders.
+func (op *OrderProcessor) AverageFulfillmentTime() (time.Duration, error) {
+	var total time.Duration
+	shipped := 0
+	for _, order := range op.orders {
+		if order.ShippedAt.IsZero() {
+			continue
+		}
+		total += order.ShippedAt.Sub(order.CreatedAt)
+		shipped++
+	}
+	if shipped == 0 {
+		return 0, ErrNoShippedOrders
+	}
+	return total / time.Duration(shipped), nil
+}
+
+func (op *OrderProcessor) ComputeChange(order *Order, amountTendered float64) (float64, error) {
+	if order.PaymentMethod != PaymentCash {
+		return 0, errors.New("change only applies to cash on delivery orders")
+	}
+	if order.Status != StatusPaid && order.Status != StatusShipped {
+		return 0, ErrPaymentNotConfirmed
+	}
+	if amountTendered < order.TotalAmount {
+		return 0, fmt.Errorf("tendered %.2f is less than the total %.2f", amountTendered, order.TotalAmount)
+	}
+	return amountTendered - order.TotalAmount, nil
+}
+
+func (op *OrderProcessor) AddNote(order *Order, author, text string) {
+	op.addNote(order, author, text, false)
+}
+
+// AddInternalNote adds a note that PublicNotes hides from the customer.
+func (op *OrderProcessor) AddInternalNote(order *Order, author, text string) {
+	op.addNote(order, author, text, true)
+}
+
+func (op *OrderProcessor) addNote(order *Order, author, text string, internal bool) {
+	order.Notes = append(order.Notes, OrderNote{
+		Author:   author,
+		Text:     text,
+		Internal: internal,
+		At:       op.now(),
+	})
+}
+
+func (op *OrderProcessor) PublicNotes(order *Order) []OrderNote {
+	var notes []OrderNote
+	for _, n := range order.Notes {
+		if !n.Internal {
+			notes = append(notes, n)
+		}
+	}
+	return notes
+}
+
+func (op *OrderProcessor) GenerateReceipt(order *Order) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Receipt for order #%d (%s)\n", order.ID, order.CustomerName)
+	if order.InvoiceNumber != "" {
+		fmt.Fprintf(&sb, "Invoice: %s\n", order.InvoiceNumber)
+	}
+	for _, item := range order.Cart.Items {
+		price := op.unitPrice(item)
+		fmt.Fprintf(&sb, "%s x%d @ %.2f = %.2f", item.Product.Name, item.Quantity,
+			price, price*float64(item.Quantity))
+		if item.Note != "" {
+			fmt.Fprintf(&sb, " [%s]", item.Note)
+		}
+		sb.WriteString("\n")
+	}
+	fmt.Fprintf(&sb, "Subtotal: %.2f\n", op.subtotal(&order.Cart))
+	if order.Tax > 0 {
+		fmt.Fprintf(&sb, "Tax: %.2f\n", order.Tax)
+	}
+	if order.CreditApplied > 0 {
+		fmt.Fprintf(&sb, "Store credit: -%.2f\n", order.CreditApplied)
+	}
+	if order.Status == StatusPaid || order.Status == StatusShipped {
+		fmt.Fprintf(&sb, "Total paid: %.2f\n", order.TotalAmount)
+	}
+	return sb.String()
+}
+
+func (op *OrderProcessor) CancelOrder(order *Order) error {
+	if err := advance(order, "cancel"); err != nil {
+		return err
 	}
 	order.Cancelled = true
-	order.Status = "cancelled"
-	op.Notifier.Notify("Order cancelled")
+	op.restoreCredit(order)
+	op.notifyEvent("cancelled", order, "Order cancelled")
+	return nil
+}
+
+// restoreCredit returns any store credit the order used to the customer.
+func (op *OrderProcessor) restoreCredit(order *Order) {
+	if order.CreditApplied <= 0 {
+		return
+	}
+	op.credits[order.CustomerName] += order.CreditApplied
+	op.Notifier.Notify(fmt.Sprintf("Store credit restored: %.2f", order.CreditApplied))
+	order.CreditApplied = 0
+}
+
+// notifyEvent sends the operator template for event if one is configured and
+// renders cleanly, and the built-in fallback message otherwise.
+func (op *OrderProcessor) notifyEvent(event string, order *Order, fallback string) {
+	msg := fallback
+	if body, ok := op.Templates[event]; ok {
+		var sb strings.Builder
+		tmpl, err := template.New(event).Parse(body)
+		if err == nil {
+			err = tmpl.Execute(&sb, order)
+		}
+		if err == nil {
+			msg = sb.String()
+		}
+	}
+	op.Notifier.Notify(msg)
 }
 
 func main() {
@@ -153,11 +1270,15 @@ func main() {
 	cart.AddProduct(charger, 2)
 	fmt.Printf("Cart: %.2f RUB\n", cart.GetTotal())
 
-	order := processor.CreateOrder(cart, "Ivan Petrov", "10 Lenin St", PaymentCard)
+	order, err := processor.CreateOrder(cart, "Ivan Petrov", "10 Lenin St", PaymentCard)
+	if err != nil {
+		fmt.Println("Order error:", err)
+		return
+	}
 
 	promo := &PromoCode{Code: "SAVE10", DiscountPercent: 10}
 
-	err := processor.Pay(order, promo)
+	err = processor.Pay(order, promo)
 	if err != nil {
 		fmt.Println("Payment error:", err)
 		processor.Pay(order, nil)
@@ -168,13 +1289,15 @@ func main() {
 	fmt.Println("\n--- Scenario: cancellation before payment ---")
 	cart2 := processor.CreateCart()
 	cart2.AddProduct(phone, 1)
-	order2 := processor.CreateOrder(cart2, "Maria", "5 Pushkin St", PaymentCash)
+	order2, _ := processor.CreateOrder(cart2, "Maria", "5 Pushkin St", PaymentCash)
 	processor.CancelOrder(order2)
 
 	fmt.Println("\n--- Scenario: cancellation attempt after payment ---")
 	cart3 := processor.CreateCart()
 	cart3.AddProduct(charger, 1)
-	order3 := processor.CreateOrder(cart3, "Alexey", "1 Gagarin St", PaymentPayPal)
+	order3, _ := processor.CreateOrder(cart3, "Alexey", "1 Gagarin St", PaymentPayPal)
 	processor.Pay(order3, nil)
-	processor.CancelOrder(order3)
+	if err := processor.CancelOrder(order3); err != nil {
+		fmt.Println("Cancel error:", err)
+	}
 }
@@ -0,0 +1,1171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testPhone   = Product{ID: 1, Name: "Smartphone", Price: 50000}
+	testCharger = Product{ID: 2, Name: "Charger", Price: 1500}
+)
+
+func newTestOrder(t *testing.T, op *OrderProcessor, method PaymentMethod, items ...CartItem) *Order {
+	t.Helper()
+	cart := op.CreateCart()
+	cart.Items = append(cart.Items, items...)
+	order, err := op.CreateOrder(cart, "Ivan", "10 Lenin St", method)
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	return order
+}
+
+func TestCreateOrderSnapshotsCart(t *testing.T) {
+	op := NewOrderProcessor()
+	cart := op.CreateCart()
+	cart.AddProduct(testPhone, 1)
+	cart.AddProduct(testCharger, 2)
+
+	order, err := op.CreateOrder(cart, "Ivan", "10 Lenin St", PaymentCard)
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	cart.Items[0].Quantity = 5
+	cart.Items[1].Product.Price = 1
+	cart.AddProduct(testPhone, 1)
+
+	if len(order.Cart.Items) != 2 {
+		t.Fatalf("order has %d items, want 2", len(order.Cart.Items))
+	}
+	if got := order.Cart.Items[0].Quantity; got != 1 {
+		t.Errorf("phone quantity = %d, want 1", got)
+	}
+	if got := order.Cart.Items[1].Product.Price; got != 1500 {
+		t.Errorf("charger price = %.2f, want 1500", got)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	op := NewOrderProcessor()
+	op.SetStock(testPhone.ID, 2)
+	first := newTestOrder(t, op, PaymentCard,
+		CartItem{Product: testPhone, Quantity: 1},
+		CartItem{Product: testCharger, Quantity: 2, Note: "gift wrap"})
+	if err := op.Pay(first, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+
+	again, err := op.Reorder(first.ID, "Ivan", "10 Lenin St", PaymentCash)
+	if err != nil {
+		t.Fatalf("Reorder: %v", err)
+	}
+	if again.ID == first.ID {
+		t.Errorf("reorder reused order ID %d", first.ID)
+	}
+	if again.Status != StatusCreated || again.PaymentMethod != PaymentCash {
+		t.Errorf("reorder status %s method %s, want created via cash", again.Status, again.PaymentMethod)
+	}
+	if len(again.Cart.Items) != len(first.Cart.Items) {
+		t.Fatalf("reorder has %d items, want %d", len(again.Cart.Items), len(first.Cart.Items))
+	}
+	for i, item := range again.Cart.Items {
+		if item != first.Cart.Items[i] {
+			t.Errorf("item %d = %+v, want %+v", i, item, first.Cart.Items[i])
+		}
+	}
+
+	if err := op.Pay(again, nil); err != nil {
+		t.Fatalf("Pay reorder: %v", err)
+	}
+	if _, err := op.Reorder(first.ID, "Ivan", "10 Lenin St", PaymentCard); !errors.Is(err, ErrInsufficientStock) {
+		t.Errorf("Reorder with no stock: got %v, want ErrInsufficientStock", err)
+	}
+	if _, err := op.Reorder(99, "Ivan", "10 Lenin St", PaymentCard); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("Reorder of unknown order: got %v, want ErrOrderNotFound", err)
+	}
+}
+
+func TestOrderSentinelErrors(t *testing.T) {
+	op := NewOrderProcessor()
+	if _, err := op.CreateOrder(op.CreateCart(), "Ivan", "10 Lenin St", PaymentCard); !errors.Is(err, ErrEmptyCart) {
+		t.Errorf("CreateOrder with empty cart: got %v, want ErrEmptyCart", err)
+	}
+
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testPhone, Quantity: 1})
+	if err := op.ProcessAndShip(order); !errors.Is(err, ErrPaymentNotConfirmed) {
+		t.Errorf("ProcessAndShip before payment: got %v, want ErrPaymentNotConfirmed", err)
+	}
+
+	op.Gateway = func(PaymentMethod) bool { return false }
+	if err := op.Pay(order, nil); !errors.Is(err, ErrPaymentFailed) {
+		t.Errorf("Pay with declined payment: got %v, want ErrPaymentFailed", err)
+	}
+	if order.Status != StatusCreated {
+		t.Errorf("status after failed payment = %s, want created", order.Status)
+	}
+
+	if err := op.CancelOrder(order); err != nil {
+		t.Fatalf("CancelOrder: %v", err)
+	}
+	if err := op.Pay(order, nil); !errors.Is(err, ErrOrderCancelled) {
+		t.Errorf("Pay of cancelled order: got %v, want ErrOrderCancelled", err)
+	}
+}
+
+func TestPayContextCancelled(t *testing.T) {
+	op := NewOrderProcessor()
+	charges := 0
+	op.Gateway = func(PaymentMethod) bool { charges++; return true }
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testPhone, Quantity: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := op.PayContext(ctx, order, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("PayContext: got %v, want context.Canceled", err)
+	}
+	if charges != 0 {
+		t.Errorf("gateway charged %d times, want 0", charges)
+	}
+	if order.Status != StatusCreated || order.InvoiceNumber != "" {
+		t.Errorf("order changed after cancelled payment: status %s invoice %q", order.Status, order.InvoiceNumber)
+	}
+}
+
+func TestPayContextStopsBetweenRetries(t *testing.T) {
+	op := NewOrderProcessor()
+	op.PaymentAttempts = 3
+	op.PaymentRetryDelay = time.Hour
+	charges := 0
+	op.Gateway = func(PaymentMethod) bool { charges++; return false }
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testPhone, Quantity: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := op.PayContext(ctx, order, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("PayContext: got %v, want context.DeadlineExceeded", err)
+	}
+	if charges != 1 {
+		t.Errorf("gateway charged %d times, want 1", charges)
+	}
+}
+
+func TestCustomProductNoteOnReceipt(t *testing.T) {
+	op := NewOrderProcessor()
+	cart := op.CreateCart()
+	if err := cart.AddCustomProduct(testPhone, 1, "engrave: To Anna"); err != nil {
+		t.Fatalf("AddCustomProduct: %v", err)
+	}
+	if got := cart.GetTotal(); got != testPhone.Price {
+		t.Errorf("total = %.2f, want %.2f", got, testPhone.Price)
+	}
+	order, err := op.CreateOrder(cart, "Ivan", "10 Lenin St", PaymentCard)
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	receipt := op.GenerateReceipt(order)
+	if !strings.Contains(receipt, "Smartphone x1 @ 50000.00 = 50000.00 [engrave: To Anna]") {
+		t.Errorf("receipt missing noted line:\n%s", receipt)
+	}
+}
+
+func TestPaySplit(t *testing.T) {
+	op := NewOrderProcessor()
+	order := newTestOrder(t, op, PaymentCard,
+		CartItem{Product: testPhone, Quantity: 1},
+		CartItem{Product: testCharger, Quantity: 2})
+
+	if err := op.PaySplit(order, []PaymentPart{{PaymentCard, 50000}, {PaymentCash, 1000}}); !errors.Is(err, ErrSplitMismatch) {
+		t.Fatalf("PaySplit with short sum: got %v, want ErrSplitMismatch", err)
+	}
+	if order.Status != StatusCreated {
+		t.Fatalf("status after rejected split = %s, want created", order.Status)
+	}
+
+	if err := op.PaySplit(order, []PaymentPart{{PaymentCard, 63000}, {PaymentCash, -10000}}); err == nil {
+		t.Fatal("PaySplit with a negative part succeeded, want error")
+	}
+
+	if err := op.PaySplit(order, []PaymentPart{{PaymentCard, 50000}, {PaymentCash, 3000}}); err != nil {
+		t.Fatalf("PaySplit: %v", err)
+	}
+	if order.Status != StatusPaid || order.TotalAmount != 53000 {
+		t.Errorf("after split: status %s total %.2f, want paid 53000", order.Status, order.TotalAmount)
+	}
+}
+
+func TestPaySplitFailingPart(t *testing.T) {
+	op := NewOrderProcessor()
+	var charged []PaymentMethod
+	op.Gateway = func(method PaymentMethod) bool {
+		charged = append(charged, method)
+		return method != PaymentCash
+	}
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+
+	if err := op.PaySplit(order, []PaymentPart{{PaymentCard, 2000}, {PaymentCash, 1000}}); !errors.Is(err, ErrPaymentFailed) {
+		t.Fatalf("PaySplit: got %v, want ErrPaymentFailed", err)
+	}
+	if order.Status != StatusCreated {
+		t.Errorf("status = %s, want created", order.Status)
+	}
+	// The card part was charged before the cash part failed and is not voided.
+	if len(charged) != 2 || charged[0] != PaymentCard {
+		t.Errorf("charged %v, want the card part then the failing cash part", charged)
+	}
+}
+
+func TestExportStatusDOT(t *testing.T) {
+	dot := ExportStatusDOT()
+	for _, line := range []string{
+		`"created" -> "paid" [label="pay"];`,
+		`"paid" -> "shipped" [label="ship"];`,
+		`"created" -> "cancelled" [label="cancel"];`,
+		`"shipped" -> "refunded" [label="refund"];`,
+		`"refunded" [shape=doublecircle];`,
+	} {
+		if !strings.Contains(dot, line) {
+			t.Errorf("ExportStatusDOT missing %s:\n%s", line, dot)
+		}
+	}
+}
+
+func TestStatusChangesFollowTransitions(t *testing.T) {
+	op := NewOrderProcessor()
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	if err := op.Pay(order, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if err := op.CancelOrder(order); err == nil {
+		t.Error("CancelOrder of a paid order succeeded, want error")
+	}
+	if err := op.ProcessAndShip(order); err != nil {
+		t.Fatalf("ProcessAndShip: %v", err)
+	}
+	if err := op.ProcessAndShip(order); err == nil {
+		t.Error("second ProcessAndShip succeeded, want error")
+	}
+	if order.Status != StatusShipped || order.Cancelled {
+		t.Errorf("status %s cancelled %v, want shipped and not cancelled", order.Status, order.Cancelled)
+	}
+}
+
+func TestMaxQtyPerItem(t *testing.T) {
+	op := NewOrderProcessor()
+	op.MaxQtyPerItem = 10
+	cart := op.CreateCart()
+	if err := op.AddToCart(cart, testCharger, 11); !errors.Is(err, ErrQuantityExceedsMax) {
+		t.Errorf("AddToCart(11): got %v, want ErrQuantityExceedsMax", err)
+	}
+	if err := op.AddToCart(cart, testCharger, 10); err != nil {
+		t.Fatalf("AddToCart(10): %v", err)
+	}
+	if err := op.UpdateQuantity(cart, testCharger.ID, 11); !errors.Is(err, ErrQuantityExceedsMax) {
+		t.Errorf("UpdateQuantity(11): got %v, want ErrQuantityExceedsMax", err)
+	}
+	if got := cart.Items[0].Quantity; got != 10 {
+		t.Errorf("quantity = %d, want 10", got)
+	}
+}
+
+func TestOnShip(t *testing.T) {
+	op := NewOrderProcessor()
+	var shipped []int
+	op.OnShip = func(order *Order) {
+		if order.Status != StatusShipped || order.TrackingNumber == "" {
+			t.Errorf("OnShip got order %d in status %s with tracking %q", order.ID, order.Status, order.TrackingNumber)
+		}
+		shipped = append(shipped, order.ID)
+	}
+	for i := 0; i < 2; i++ {
+		order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+		if err := op.Pay(order, nil); err != nil {
+			t.Fatalf("Pay: %v", err)
+		}
+		if err := op.ProcessAndShip(order); err != nil {
+			t.Fatalf("ProcessAndShip: %v", err)
+		}
+		op.ProcessAndShip(order)
+	}
+	if len(shipped) != 2 || shipped[0] != 1 || shipped[1] != 2 {
+		t.Errorf("OnShip saw %v, want [1 2]", shipped)
+	}
+}
+
+func TestShippingAddressRequired(t *testing.T) {
+	op := NewOrderProcessor()
+	cart := op.CreateCart()
+	cart.AddProduct(testCharger, 1)
+
+	physical, _ := op.CreateOrder(cart, "Ivan", "  ", PaymentCard)
+	if err := op.Pay(physical, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if err := op.ProcessAndShip(physical); !errors.Is(err, ErrAddressRequired) {
+		t.Errorf("ProcessAndShip without address: got %v, want ErrAddressRequired", err)
+	}
+	if physical.Status != StatusPaid {
+		t.Errorf("status = %s, want paid", physical.Status)
+	}
+
+	digital, _ := op.CreateOrder(cart, "Ivan", "", PaymentCard)
+	digital.Digital = true
+	if err := op.Pay(digital, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if err := op.ProcessAndShip(digital); err != nil {
+		t.Errorf("ProcessAndShip of digital order: %v", err)
+	}
+	if digital.Status != StatusShipped || digital.TrackingNumber != "" {
+		t.Errorf("digital order: status %s tracking %q, want shipped without tracking", digital.Status, digital.TrackingNumber)
+	}
+}
+
+type fixedClock struct{ t time.Time }
+
+func (c *fixedClock) Now() time.Time { return c.t }
+
+func TestEstimatedDelivery(t *testing.T) {
+	op := NewOrderProcessor()
+	clock := &fixedClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	op.Clock = clock
+	op.DeliveryDays = 3
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	if _, err := op.EstimatedDelivery(order); !errors.Is(err, ErrNotShipped) {
+		t.Errorf("EstimatedDelivery before shipping: got %v, want ErrNotShipped", err)
+	}
+	op.Pay(order, nil)
+	if err := op.ProcessAndShip(order); err != nil {
+		t.Fatalf("ProcessAndShip: %v", err)
+	}
+	got, err := op.EstimatedDelivery(order)
+	if err != nil {
+		t.Fatalf("EstimatedDelivery: %v", err)
+	}
+	if want := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("EstimatedDelivery = %v, want %v", got, want)
+	}
+}
+
+func TestLoyaltyPoints(t *testing.T) {
+	op := NewOrderProcessor()
+	first := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	second := newTestOrder(t, op, PaymentCard, CartItem{Product: testPhone, Quantity: 1})
+	for _, order := range []*Order{first, second} {
+		if err := op.Pay(order, nil); err != nil {
+			t.Fatalf("Pay: %v", err)
+		}
+	}
+	if got := op.LoyaltyPoints("Ivan"); got != 515 {
+		t.Errorf("points after two orders = %d, want 515", got)
+	}
+	if err := op.Refund(second); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if got := op.LoyaltyPoints("Ivan"); got != 15 {
+		t.Errorf("points after refund = %d, want 15", got)
+	}
+}
+
+func TestRefundRestocks(t *testing.T) {
+	op := NewOrderProcessor()
+	op.SetStock(testCharger.ID, 5)
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+	if err := op.Pay(order, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if err := op.Refund(order); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if got := op.stock[testCharger.ID]; got != 5 {
+		t.Errorf("stock after refund = %d, want 5", got)
+	}
+}
+
+func TestProcessAndShipBatch(t *testing.T) {
+	op := NewOrderProcessor()
+	orders := make([]*Order, 4)
+	for i := range orders {
+		orders[i] = newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+		if i%2 == 0 {
+			op.Pay(orders[i], nil)
+		}
+	}
+	errs := op.ProcessAndShipBatch(orders)
+	if len(errs) != len(orders) {
+		t.Fatalf("got %d errors, want %d", len(errs), len(orders))
+	}
+	for i, err := range errs {
+		if i%2 == 0 {
+			if err != nil || orders[i].Status != StatusShipped {
+				t.Errorf("paid order %d: err %v status %s, want shipped", i, err, orders[i].Status)
+			}
+		} else if !errors.Is(err, ErrPaymentNotConfirmed) {
+			t.Errorf("unpaid order %d: got %v, want ErrPaymentNotConfirmed", i, err)
+		}
+	}
+}
+
+func TestApplyPromo(t *testing.T) {
+	op := NewOrderProcessor()
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testPhone, Quantity: 1})
+	if err := op.ApplyPromo(order, &PromoCode{Code: "SAVE5", DiscountPercent: 5}); err != nil {
+		t.Fatalf("ApplyPromo: %v", err)
+	}
+	if err := op.ApplyPromo(order, &PromoCode{Code: "SAVE10", DiscountPercent: 10}); err != nil {
+		t.Fatalf("ApplyPromo: %v", err)
+	}
+	if err := op.ApplyPromo(order, &PromoCode{Code: "BROKEN"}); err == nil {
+		t.Error("ApplyPromo with an invalid promo succeeded, want error")
+	}
+	if err := op.Pay(order, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if order.TotalAmount != 45000 {
+		t.Errorf("total = %.2f, want 45000", order.TotalAmount)
+	}
+	if err := op.ApplyPromo(order, &PromoCode{Code: "LATE", DiscountPercent: 50}); err == nil {
+		t.Error("ApplyPromo after payment succeeded, want error")
+	}
+}
+
+func TestAuthorizeCapture(t *testing.T) {
+	op := NewOrderProcessor()
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+	if err := op.Capture(order); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("Capture without authorization: got %v, want ErrNotAuthorized", err)
+	}
+	if err := op.Authorize(order, nil); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if order.Status != StatusAuthorized || order.TotalAmount != 3000 {
+		t.Errorf("after Authorize: status %s total %.2f, want authorized 3000", order.Status, order.TotalAmount)
+	}
+	if err := op.ProcessAndShip(order); !errors.Is(err, ErrPaymentNotConfirmed) {
+		t.Errorf("ProcessAndShip before capture: got %v, want ErrPaymentNotConfirmed", err)
+	}
+	if err := op.Pay(order, nil); err == nil {
+		t.Error("Pay of an authorized order succeeded, want error")
+	}
+	if err := op.PaySplit(order, []PaymentPart{{PaymentCard, 3000}}); err == nil {
+		t.Error("PaySplit of an authorized order succeeded, want error")
+	}
+	if err := op.Capture(order); err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	if order.Status != StatusPaid || order.TotalAmount != 3000 {
+		t.Errorf("after Capture: status %s total %.2f, want paid 3000", order.Status, order.TotalAmount)
+	}
+	if err := op.Capture(order); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("second Capture: got %v, want ErrNotAuthorized", err)
+	}
+}
+
+func TestCaptureRechecksStock(t *testing.T) {
+	op := NewOrderProcessor()
+	op.SetStock(testCharger.ID, 1)
+	first := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	second := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	for _, o := range []*Order{first, second} {
+		if err := op.Authorize(o, nil); err != nil {
+			t.Fatalf("Authorize: %v", err)
+		}
+	}
+	if err := op.Capture(first); err != nil {
+		t.Fatalf("Capture: %v", err)
+	}
+	if err := op.Capture(second); !errors.Is(err, ErrInsufficientStock) {
+		t.Errorf("Capture of the last unit twice: got %v, want ErrInsufficientStock", err)
+	}
+	if second.Status != StatusAuthorized || op.stock[testCharger.ID] != 0 {
+		t.Errorf("after failed capture: status %s stock %d, want authorized and 0", second.Status, op.stock[testCharger.ID])
+	}
+}
+
+func TestDiscountTiers(t *testing.T) {
+	tiers := []Tier{{MinTotal: 10000, DiscountPercent: 5}, {MinTotal: 50000, DiscountPercent: 10}}
+	for _, tc := range []struct {
+		name  string
+		qty   int
+		promo *PromoCode
+		stack bool
+		tier  float64
+		total float64
+	}{
+		{"below tiers", 2, nil, false, 0, 3000},
+		{"first tier", 8, nil, false, 600, 11400},
+		{"second tier", 40, nil, false, 6000, 54000},
+		{"larger promo wins", 8, &PromoCode{Code: "P20", DiscountPercent: 20}, false, 0, 9600},
+		{"larger tier wins", 40, &PromoCode{Code: "P5", DiscountPercent: 5}, false, 6000, 54000},
+		{"stacked", 40, &PromoCode{Code: "P5", DiscountPercent: 5}, true, 6000, 51000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			op := NewOrderProcessor()
+			op.DiscountTiers = tiers
+			op.StackTierAndPromo = tc.stack
+			order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: tc.qty})
+			if err := op.Pay(order, tc.promo); err != nil {
+				t.Fatalf("Pay: %v", err)
+			}
+			if order.TierDiscount != tc.tier || order.TotalAmount != tc.total {
+				t.Errorf("tier discount %.2f total %.2f, want %.2f and %.2f", order.TierDiscount, order.TotalAmount, tc.tier, tc.total)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	op := NewOrderProcessor()
+	notifier := &BatchNotifier{}
+	op.Notifier = notifier
+	op.DryRun = true
+	op.SetStock(testCharger.ID, 5)
+	charges := 0
+	op.Gateway = func(PaymentMethod) bool { charges++; return true }
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+
+	if err := op.Pay(order, &PromoCode{Code: "SAVE10", DiscountPercent: 10}); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if order.Status != StatusCreated || order.TotalAmount != 0 || order.InvoiceNumber != "" {
+		t.Errorf("dry run changed the order: status %s total %.2f invoice %q", order.Status, order.TotalAmount, order.InvoiceNumber)
+	}
+	if op.stock[testCharger.ID] != 5 || charges != 0 {
+		t.Errorf("dry run left stock %d after %d charges, want 5 and 0", op.stock[testCharger.ID], charges)
+	}
+	want := "Dry run for order #1: subtotal 3000.00, discounts 300.00, tax 0.00, total 2700.00"
+	if msgs := notifier.Flush(); len(msgs) != 1 || msgs[0] != want {
+		t.Errorf("notifications = %q, want [%q]", msgs, want)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	combo := Bundle{ID: 1, Name: "Phone + Charger", Products: []Product{testPhone, testCharger}, Price: 49000}
+	bundled := &Cart{}
+	if err := bundled.AddBundle(combo, 2); err != nil {
+		t.Fatalf("AddBundle: %v", err)
+	}
+	separate := &Cart{}
+	separate.AddProduct(testPhone, 2)
+	separate.AddProduct(testCharger, 2)
+	if got := bundled.GetTotal(); got != 98000 {
+		t.Errorf("bundle total = %.2f, want 98000", got)
+	}
+	if got := separate.GetTotal(); got != 103000 {
+		t.Errorf("separate total = %.2f, want 103000", got)
+	}
+
+	op := NewOrderProcessor()
+	op.SetStock(testCharger.ID, 1)
+	order, _ := op.CreateOrder(bundled, "Ivan", "10 Lenin St", PaymentCard)
+	if err := op.Pay(order, nil); !errors.Is(err, ErrInsufficientStock) {
+		t.Errorf("Pay with 1 charger in stock: got %v, want ErrInsufficientStock", err)
+	}
+}
+
+func TestBundleLinesAreNotProducts(t *testing.T) {
+	combo := Bundle{ID: testPhone.ID, Name: "Combo", Products: []Product{testPhone, testCharger}, Price: 49000}
+	op := NewOrderProcessor()
+	cart := op.CreateCart()
+	cart.AddBundle(combo, 1)
+	cart.AddProduct(testPhone, 1)
+
+	if got := cart.GetTotalExcluding(testPhone.ID); got != 49000 {
+		t.Errorf("GetTotalExcluding(phone) = %.2f, want 49000", got)
+	}
+	if got, _ := cart.AveragePrice(testPhone.ID); got != 50000 {
+		t.Errorf("AveragePrice(phone) = %.2f, want 50000", got)
+	}
+	if err := op.UpdateQuantity(cart, testPhone.ID, 3); err != nil || cart.Items[0].Quantity != 1 || cart.Items[1].Quantity != 3 {
+		t.Errorf("UpdateQuantity(phone) changed the wrong line: err %v, quantities %d/%d", err, cart.Items[0].Quantity, cart.Items[1].Quantity)
+	}
+
+	order, _ := op.CreateOrder(cart, "Ivan", "10 Lenin St", PaymentCard)
+	cart.Items[0].Bundle.Name = "Changed"
+	cart.Items[0].Bundle.Products[0].Price = 1
+	if b := order.Cart.Items[0].Bundle; b.Name != "Combo" || b.Products[0].Price != testPhone.Price {
+		t.Errorf("order bundle shares state with the cart: %+v", b)
+	}
+	if err := op.Pay(order, &PromoCode{Code: "PHONE10", DiscountPercent: 10, AppliesTo: []int{testPhone.ID}}); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if order.TotalAmount != 184000 {
+		t.Errorf("total = %.2f, want 184000 (promo on the phone line only)", order.TotalAmount)
+	}
+}
+
+func TestComputeChange(t *testing.T) {
+	op := NewOrderProcessor()
+	order := newTestOrder(t, op, PaymentCash, CartItem{Product: testCharger, Quantity: 2})
+	if _, err := op.ComputeChange(order, 5000); !errors.Is(err, ErrPaymentNotConfirmed) {
+		t.Errorf("ComputeChange before payment: got %v, want ErrPaymentNotConfirmed", err)
+	}
+	op.Pay(order, nil)
+
+	for _, tc := range []struct {
+		tendered, change float64
+		wantErr          bool
+	}{
+		{3000, 0, false},
+		{5000, 2000, false},
+		{2999, 0, true},
+	} {
+		change, err := op.ComputeChange(order, tc.tendered)
+		if (err != nil) != tc.wantErr || change != tc.change {
+			t.Errorf("ComputeChange(%.2f) = %.2f, %v; want %.2f, error %v", tc.tendered, change, err, tc.change, tc.wantErr)
+		}
+	}
+
+	card := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	op.Pay(card, nil)
+	if _, err := op.ComputeChange(card, 5000); err == nil {
+		t.Error("ComputeChange for a card order succeeded, want error")
+	}
+}
+
+func TestBatchNotifier(t *testing.T) {
+	bn := &BatchNotifier{}
+	for _, msg := range []string{"first", "second", "third"} {
+		bn.Notify(msg)
+	}
+	got := bn.Flush()
+	if len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "third" {
+		t.Errorf("Flush() = %q, want [first second third]", got)
+	}
+	if got := bn.Flush(); len(got) != 0 {
+		t.Errorf("second Flush() = %q, want empty", got)
+	}
+}
+
+func TestRevalidateCart(t *testing.T) {
+	op := NewOrderProcessor()
+	cart := op.CreateCart()
+	cart.AddProduct(testPhone, 1)
+	cart.AddProduct(testCharger, 1)
+	catalog := map[int]Product{testPhone.ID: {ID: testPhone.ID, Name: "Smartphone", Price: 45000}}
+
+	warnings := op.RevalidateCart(cart, catalog)
+	want := []string{
+		"Smartphone price changed from 50000.00 to 45000.00",
+		"Charger is no longer in the catalog",
+	}
+	if len(warnings) != len(want) || warnings[0] != want[0] || warnings[1] != want[1] {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+	if cart.Items[0].Product.Price != 50000 {
+		t.Errorf("price updated without RepriceStaleItems: %.2f", cart.Items[0].Product.Price)
+	}
+
+	op.RepriceStaleItems = true
+	op.RevalidateCart(cart, catalog)
+	if cart.Items[0].Product.Price != 45000 {
+		t.Errorf("price = %.2f with RepriceStaleItems, want 45000", cart.Items[0].Product.Price)
+	}
+}
+
+func TestOnLowStock(t *testing.T) {
+	op := NewOrderProcessor()
+	op.SetStock(testCharger.ID, 5)
+	op.SetStock(testPhone.ID, 10)
+	op.LowStockThreshold = 2
+	var alerts [][2]int
+	op.OnLowStock = func(productID, remaining int) {
+		alerts = append(alerts, [2]int{productID, remaining})
+	}
+
+	first := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2}, CartItem{Product: testPhone, Quantity: 1})
+	op.Pay(first, nil)
+	if len(alerts) != 0 {
+		t.Fatalf("alerts after first order = %v, want none", alerts)
+	}
+	second := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+	if err := op.Pay(second, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if len(alerts) != 1 || alerts[0] != [2]int{testCharger.ID, 1} {
+		t.Errorf("alerts = %v, want [[%d 1]]", alerts, testCharger.ID)
+	}
+}
+
+func TestNotificationTemplates(t *testing.T) {
+	op := NewOrderProcessor()
+	notifier := &BatchNotifier{}
+	op.Notifier = notifier
+	op.Templates = map[string]string{
+		"shipped": "Order {{.ID}} for {{.CustomerName}} is on its way ({{.TrackingNumber}})",
+		"paid":    "{{.Missing}}",
+	}
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	op.Pay(order, nil)
+	op.ProcessAndShip(order)
+
+	msgs := notifier.Flush()
+	want := []string{
+		"Payment successful. Total: 1500.00",
+		"Order is being processed at the warehouse",
+		"Order 1 for Ivan is on its way (TRK-000001)",
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("notifications = %q, want %q", msgs, want)
+	}
+	for i := range want {
+		if msgs[i] != want[i] {
+			t.Errorf("notification %d = %q, want %q", i, msgs[i], want[i])
+		}
+	}
+}
+
+func TestOrderNotes(t *testing.T) {
+	op := NewOrderProcessor()
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	op.AddNote(order, "support", "leave at the door")
+	op.AddInternalNote(order, "support", "customer called twice")
+	op.AddNote(order, "courier", "gate code 1234")
+
+	if len(order.Notes) != 3 || !order.Notes[1].Internal || order.Notes[0].At.IsZero() {
+		t.Errorf("notes = %+v", order.Notes)
+	}
+	public := op.PublicNotes(order)
+	if len(public) != 2 || public[0].Text != "leave at the door" || public[1].Author != "courier" {
+		t.Errorf("PublicNotes = %+v, want the two public notes", public)
+	}
+}
+
+func TestFixedPromo(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		promo *PromoCode
+		qty   int
+		total float64
+	}{
+		{"fixed", &PromoCode{Code: "OFF500", DiscountType: DiscountTypeFixed, DiscountAmount: 500}, 2, 2500},
+		{"percent", &PromoCode{Code: "P10", DiscountType: DiscountTypePercent, DiscountPercent: 10}, 2, 2700},
+		{"fixed clamped", &PromoCode{Code: "OFF5000", DiscountType: DiscountTypeFixed, DiscountAmount: 5000}, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			op := NewOrderProcessor()
+			order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: tc.qty})
+			if err := op.Pay(order, tc.promo); err != nil {
+				t.Fatalf("Pay: %v", err)
+			}
+			if order.TotalAmount != tc.total {
+				t.Errorf("total = %.2f, want %.2f", order.TotalAmount, tc.total)
+			}
+		})
+	}
+}
+
+func TestAveragePrice(t *testing.T) {
+	cart := &Cart{}
+	cart.AddProduct(Product{ID: 7, Name: "Cable", Price: 100}, 2)
+	cart.AddProduct(Product{ID: 7, Name: "Cable", Price: 80}, 3)
+	cart.AddProduct(testCharger, 1)
+	got, err := cart.AveragePrice(7)
+	if err != nil {
+		t.Fatalf("AveragePrice: %v", err)
+	}
+	if got != 88 {
+		t.Errorf("AveragePrice = %.2f, want 88", got)
+	}
+	if _, err := cart.AveragePrice(99); !errors.Is(err, ErrItemNotInCart) {
+		t.Errorf("AveragePrice of missing product: got %v, want ErrItemNotInCart", err)
+	}
+}
+
+func TestQuantityBreaks(t *testing.T) {
+	for _, tc := range []struct {
+		qty   int
+		total float64
+	}{
+		{3, 300},
+		{5, 450},
+		{12, 960},
+	} {
+		op := NewOrderProcessor()
+		op.QuantityBreaks = map[int][]Break{7: {{MinQuantity: 10, UnitPrice: 80}, {MinQuantity: 5, UnitPrice: 90}}}
+		order := newTestOrder(t, op, PaymentCard, CartItem{Product: Product{ID: 7, Name: "Cable", Price: 100}, Quantity: tc.qty})
+		if err := op.Pay(order, nil); err != nil {
+			t.Fatalf("Pay: %v", err)
+		}
+		if order.TotalAmount != tc.total {
+			t.Errorf("%d units: total %.2f, want %.2f", tc.qty, order.TotalAmount, tc.total)
+		}
+	}
+}
+
+func TestAverageFulfillmentTime(t *testing.T) {
+	op := NewOrderProcessor()
+	clock := &fixedClock{t: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+	op.Clock = clock
+	if _, err := op.AverageFulfillmentTime(); !errors.Is(err, ErrNoShippedOrders) {
+		t.Errorf("AverageFulfillmentTime with no orders: got %v, want ErrNoShippedOrders", err)
+	}
+	first := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	second := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	op.Pay(first, nil)
+	op.Pay(second, nil)
+
+	clock.t = clock.t.Add(2 * time.Hour)
+	op.ProcessAndShip(first)
+	clock.t = clock.t.Add(4 * time.Hour)
+	op.ProcessAndShip(second)
+
+	got, err := op.AverageFulfillmentTime()
+	if err != nil {
+		t.Fatalf("AverageFulfillmentTime: %v", err)
+	}
+	if got != 4*time.Hour {
+		t.Errorf("AverageFulfillmentTime = %v, want 4h", got)
+	}
+}
+
+func TestCartSplit(t *testing.T) {
+	ebook := Product{ID: 3, Name: "E-book", Price: 400, Category: "digital"}
+	cart := &Cart{}
+	cart.AddProduct(testPhone, 1)
+	cart.AddProduct(ebook, 2)
+	cart.AddProduct(testCharger, 2)
+
+	physical, digital := cart.Split(func(p Product) bool { return p.Category == "digital" })
+	if len(physical.Items) != 2 || physical.Items[0].Product != testPhone || physical.Items[1].Product != testCharger {
+		t.Errorf("physical items = %+v", physical.Items)
+	}
+	if len(digital.Items) != 1 || digital.Items[0].Product != ebook {
+		t.Errorf("digital items = %+v", digital.Items)
+	}
+	if physical.GetTotal() != 53000 || digital.GetTotal() != 800 {
+		t.Errorf("totals = %.2f and %.2f, want 53000 and 800", physical.GetTotal(), digital.GetTotal())
+	}
+	if len(cart.Items) != 3 {
+		t.Errorf("original cart has %d items, want 3", len(cart.Items))
+	}
+}
+
+func TestCategoryTax(t *testing.T) {
+	op := NewOrderProcessor()
+	op.TaxRates = map[string]float64{"electronics": 0.2, "books": 0.1}
+	op.DefaultTaxRate = 0.05
+	order := newTestOrder(t, op, PaymentCard,
+		CartItem{Product: Product{ID: 1, Name: "Phone", Price: 1000, Category: "electronics"}, Quantity: 1},
+		CartItem{Product: Product{ID: 2, Name: "Novel", Price: 500, Category: "books"}, Quantity: 2},
+		CartItem{Product: Product{ID: 3, Name: "Gift card", Price: 200}, Quantity: 1})
+	if err := op.Pay(order, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if math.Abs(order.Tax-310) > 1e-9 || math.Abs(order.TotalAmount-2510) > 1e-9 {
+		t.Errorf("tax %.2f total %.2f, want 310 and 2510", order.Tax, order.TotalAmount)
+	}
+}
+
+func TestImportOrdersJSON(t *testing.T) {
+	op := NewOrderProcessor()
+	newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	data := []byte(`[
+		{"ID": 10, "CustomerName": "Maria", "Status": "paid", "Cart": {"Items": [{"Product": {"ID": 2, "Name": "Charger", "Price": 1500}, "Quantity": 2}]}},
+		{"CustomerName": "Alexey", "Status": "cancelled"},
+		{"CustomerName": "Oleg", "Status": "created", "Cancelled": true}
+	]`)
+	n, err := op.ImportOrdersJSON(data)
+	if err != nil {
+		t.Fatalf("ImportOrdersJSON: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("imported %d orders, want 3", n)
+	}
+	maria, err := op.GetOrder(10)
+	if err != nil || maria.CustomerName != "Maria" || maria.Status != StatusPaid || maria.Cart.Items[0].Quantity != 2 {
+		t.Errorf("GetOrder(10) = %+v, %v", maria, err)
+	}
+	alexey, err := op.GetOrder(11)
+	if err != nil || alexey.CustomerName != "Alexey" || !alexey.Cancelled {
+		t.Errorf("GetOrder(11) = %+v, %v", alexey, err)
+	}
+	oleg, err := op.GetOrder(12)
+	if err != nil || oleg.Cancelled || oleg.Status != StatusCreated {
+		t.Errorf("GetOrder(12) = %+v, %v; want a created order that is not cancelled", oleg, err)
+	}
+	if op.NextOrderID != 13 {
+		t.Errorf("NextOrderID = %d, want 13", op.NextOrderID)
+	}
+
+	for _, bad := range []string{
+		`[{"ID": 20}, `,
+		`[{"ID": 20}, {"ID": 10}]`,
+		`[{"ID": 20}, {"ID": 21, "Status": "bogus"}]`,
+	} {
+		if _, err := op.ImportOrdersJSON([]byte(bad)); err == nil {
+			t.Errorf("ImportOrdersJSON(%s) succeeded, want error", bad)
+		}
+	}
+	if _, err := op.GetOrder(20); err == nil {
+		t.Error("a failed import left order 20 behind")
+	}
+}
+
+func TestTopProducts(t *testing.T) {
+	op := NewOrderProcessor()
+	cable := Product{ID: 3, Name: "Cable", Price: 300}
+	combo := Bundle{ID: 100, Name: "Combo", Products: []Product{testPhone, cable}, Price: 50000}
+	paid := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 3}, CartItem{Product: cable, Quantity: 1})
+	shipped := newTestOrder(t, op, PaymentCard, CartItem{Product: Product{ID: combo.ID, Name: combo.Name, Price: combo.Price}, Quantity: 2, Bundle: &combo})
+	cancelled := newTestOrder(t, op, PaymentCard, CartItem{Product: testPhone, Quantity: 9})
+	refunded := newTestOrder(t, op, PaymentCard, CartItem{Product: cable, Quantity: 9})
+	newTestOrder(t, op, PaymentCard, CartItem{Product: testPhone, Quantity: 9})
+	op.Pay(paid, nil)
+	op.Pay(shipped, nil)
+	op.ProcessAndShip(shipped)
+	op.CancelOrder(cancelled)
+	op.Pay(refunded, nil)
+	op.Refund(refunded)
+
+	got := op.TopProducts(2)
+	want := []ProductSales{{ProductID: 2, Name: "Charger", Units: 3}, {ProductID: 3, Name: "Cable", Units: 3}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("TopProducts(2) = %+v, want %+v", got, want)
+	}
+	if all := op.TopProducts(-1); len(all) != 3 || all[2] != (ProductSales{ProductID: 1, Name: "Smartphone", Units: 2}) {
+		t.Errorf("TopProducts(-1) = %+v", all)
+	}
+}
+
+func TestNegativeQuantities(t *testing.T) {
+	op := NewOrderProcessor()
+	cart := op.CreateCart()
+	cart.AddProduct(testCharger, 2)
+	for name, add := range map[string]func() error{
+		"AddProduct":       func() error { return cart.AddProduct(testPhone, -1) },
+		"AddCustomProduct": func() error { return cart.AddCustomProduct(testPhone, 0, "engraved") },
+		"AddBundle":        func() error { return cart.AddBundle(Bundle{ID: 9, Price: 100}, -1) },
+		"AddToCart":        func() error { return op.AddToCart(cart, testPhone, -1) },
+		"UpdateQuantity":   func() error { return op.UpdateQuantity(cart, testCharger.ID, -1) },
+	} {
+		if err := add(); !errors.Is(err, ErrInvalidQuantity) {
+			t.Errorf("%s: got %v, want ErrInvalidQuantity", name, err)
+		}
+	}
+	if got := cart.GetTotal(); got != 3000 {
+		t.Errorf("total = %.2f, want 3000", got)
+	}
+
+	cart.Items[0].Quantity = -1
+	if _, err := op.CreateOrder(cart, "Ivan", "10 Lenin St", PaymentCard); !errors.Is(err, ErrInvalidQuantity) {
+		t.Errorf("CreateOrder with a negative line: got %v, want ErrInvalidQuantity", err)
+	}
+}
+
+func TestPromoHelps(t *testing.T) {
+	op := NewOrderProcessor()
+	op.DiscountTiers = []Tier{{MinTotal: 10000, DiscountPercent: 10}}
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 10})
+
+	helps, total, err := op.PromoHelps(order, &PromoCode{Code: "OFF500", DiscountType: DiscountTypeFixed, DiscountAmount: 500})
+	if err != nil || helps || total != 13500 {
+		t.Errorf("small fixed promo: helps %v total %.2f err %v, want false 13500", helps, total, err)
+	}
+	helps, total, err = op.PromoHelps(order, &PromoCode{Code: "P20", DiscountPercent: 20})
+	if err != nil || !helps || total != 12000 {
+		t.Errorf("20%% promo: helps %v total %.2f err %v, want true 12000", helps, total, err)
+	}
+	if _, _, err := op.PromoHelps(order, &PromoCode{Code: "BROKEN"}); err == nil {
+		t.Error("PromoHelps with an invalid promo succeeded, want error")
+	}
+	if order.Promo != nil || order.Status != StatusCreated {
+		t.Error("PromoHelps changed the order")
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	op := NewOrderProcessor()
+	cart := op.CreateCart()
+	cart.AddProduct(testCharger, 2)
+	order, err := op.Checkout(cart, "Ivan", "10 Lenin St", PaymentCard, &PromoCode{Code: "P10", DiscountPercent: 10})
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if order.Status != StatusShipped || order.TotalAmount != 2700 || order.TrackingNumber == "" {
+		t.Errorf("order: status %s total %.2f tracking %q, want shipped 2700 with tracking", order.Status, order.TotalAmount, order.TrackingNumber)
+	}
+}
+
+func TestCheckoutPaymentFails(t *testing.T) {
+	op := NewOrderProcessor()
+	op.Gateway = func(PaymentMethod) bool { return false }
+	cart := op.CreateCart()
+	cart.AddProduct(testCharger, 2)
+	order, err := op.Checkout(cart, "Ivan", "10 Lenin St", PaymentCard, nil)
+	if !errors.Is(err, ErrPaymentFailed) {
+		t.Fatalf("Checkout: got %v, want ErrPaymentFailed", err)
+	}
+	if order == nil || order.Status != StatusCreated || order.TrackingNumber != "" {
+		t.Errorf("order after failed payment = %+v, want created and unshipped", order)
+	}
+	if _, err := op.Checkout(op.CreateCart(), "Ivan", "10 Lenin St", PaymentCard, nil); !errors.Is(err, ErrEmptyCart) {
+		t.Errorf("Checkout with an empty cart: got %v, want ErrEmptyCart", err)
+	}
+}
+
+func TestGetTotalExcluding(t *testing.T) {
+	cable := Product{ID: 3, Name: "Cable", Price: 300}
+	cart := &Cart{}
+	cart.AddProduct(testPhone, 1)
+	cart.AddProduct(testCharger, 2)
+	cart.AddProduct(cable, 3)
+	full := cart.GetTotal()
+	if got := cart.GetTotalExcluding(testCharger.ID); got != full-3000 {
+		t.Errorf("GetTotalExcluding(charger) = %.2f, want %.2f", got, full-3000)
+	}
+	if got := cart.GetTotalExcluding(99); got != full {
+		t.Errorf("GetTotalExcluding(missing) = %.2f, want %.2f", got, full)
+	}
+	if len(cart.Items) != 3 || cart.GetTotal() != full {
+		t.Error("GetTotalExcluding mutated the cart")
+	}
+}
+
+func TestStoreCredit(t *testing.T) {
+	op := NewOrderProcessor()
+	op.UseStoreCredit = true
+	charges := 0
+	op.Gateway = func(PaymentMethod) bool { charges++; return true }
+	if err := op.AddStoreCredit("Ivan", -5); err == nil {
+		t.Error("AddStoreCredit with a negative amount succeeded, want error")
+	}
+	op.AddStoreCredit("Ivan", 4000)
+
+	full := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+	if err := op.Pay(full, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if full.CreditApplied != 3000 || full.TotalAmount != 0 || charges != 0 {
+		t.Errorf("fully covered: credit %.2f total %.2f charges %d, want 3000, 0 and 0", full.CreditApplied, full.TotalAmount, charges)
+	}
+
+	partial := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+	if err := op.Pay(partial, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if partial.CreditApplied != 1000 || partial.TotalAmount != 2000 || charges != 1 {
+		t.Errorf("partly covered: credit %.2f total %.2f charges %d, want 1000, 2000 and 1", partial.CreditApplied, partial.TotalAmount, charges)
+	}
+	if got := op.StoreCredit("Ivan"); got != 0 {
+		t.Errorf("remaining credit = %.2f, want 0", got)
+	}
+}
+
+func TestPaySplitUsesStoreCredit(t *testing.T) {
+	op := NewOrderProcessor()
+	op.UseStoreCredit = true
+	op.AddStoreCredit("Ivan", 1000)
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+
+	if err := op.PaySplit(order, []PaymentPart{{PaymentCard, 2000}, {PaymentCash, 1000}}); !errors.Is(err, ErrSplitMismatch) {
+		t.Fatalf("PaySplit ignoring store credit: got %v, want ErrSplitMismatch", err)
+	}
+	if err := op.PaySplit(order, []PaymentPart{{PaymentCard, 1500}, {PaymentCash, 500}}); err != nil {
+		t.Fatalf("PaySplit: %v", err)
+	}
+	if order.CreditApplied != 1000 || order.TotalAmount != 2000 || op.StoreCredit("Ivan") != 0 {
+		t.Errorf("credit %.2f total %.2f balance %.2f, want 1000, 2000 and 0", order.CreditApplied, order.TotalAmount, op.StoreCredit("Ivan"))
+	}
+}
+
+func TestInventoryValue(t *testing.T) {
+	op := NewOrderProcessor()
+	op.SetStock(testPhone.ID, 3)
+	op.SetStock(testCharger.ID, 10)
+	op.SetStock(99, 5)
+	catalog := map[int]Product{testPhone.ID: testPhone, testCharger.ID: testCharger}
+	if got := op.InventoryValue(catalog); got != 165000 {
+		t.Errorf("InventoryValue = %.2f, want 165000", got)
+	}
+}
+
+func TestPromoAppliesTo(t *testing.T) {
+	op := NewOrderProcessor()
+	order := newTestOrder(t, op, PaymentCard,
+		CartItem{Product: testPhone, Quantity: 1},
+		CartItem{Product: testCharger, Quantity: 2})
+	if err := op.Pay(order, &PromoCode{Code: "CHARGE50", DiscountPercent: 50, AppliesTo: []int{testCharger.ID}}); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if order.TotalAmount != 51500 {
+		t.Errorf("total = %.2f, want 51500", order.TotalAmount)
+	}
+}
+
+func TestCancelOrderRestoresCredit(t *testing.T) {
+	op := NewOrderProcessor()
+	op.UseStoreCredit = true
+	op.AddStoreCredit("Ivan", 1000)
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 2})
+	if err := op.Authorize(order, nil); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if order.CreditApplied != 1000 || op.StoreCredit("Ivan") != 0 {
+		t.Fatalf("credit applied %.2f, balance %.2f; want 1000 and 0", order.CreditApplied, op.StoreCredit("Ivan"))
+	}
+	if err := op.CancelOrder(order); err != nil {
+		t.Fatalf("CancelOrder: %v", err)
+	}
+	if got := op.StoreCredit("Ivan"); got != 1000 {
+		t.Errorf("balance after cancel = %.2f, want 1000", got)
+	}
+	if order.CreditApplied != 0 {
+		t.Errorf("CreditApplied = %.2f after cancel, want 0", order.CreditApplied)
+	}
+}
+
+func TestInvoiceNumbers(t *testing.T) {
+	op := NewOrderProcessor()
+	first := newTestOrder(t, op, PaymentCard, CartItem{Product: testPhone, Quantity: 1})
+	second := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	unpaid := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	for _, o := range []*Order{first, second} {
+		if err := op.Pay(o, nil); err != nil {
+			t.Fatalf("Pay: %v", err)
+		}
+	}
+	if first.InvoiceNumber != "INV-00001" || second.InvoiceNumber != "INV-00002" {
+		t.Errorf("invoice numbers = %q, %q; want INV-00001, INV-00002", first.InvoiceNumber, second.InvoiceNumber)
+	}
+	if unpaid.InvoiceNumber != "" {
+		t.Errorf("unpaid order has invoice %q", unpaid.InvoiceNumber)
+	}
+	if err := op.Pay(first, nil); err == nil {
+		t.Error("paying an already paid order succeeded")
+	}
+	if first.InvoiceNumber != "INV-00001" {
+		t.Errorf("invoice reissued as %q", first.InvoiceNumber)
+	}
+
+	if o, err := op.FindByInvoice("INV-00002"); err != nil || o != second {
+		t.Errorf("FindByInvoice(INV-00002) = %v, %v; want the second order", o, err)
+	}
+	for _, number := range []string{"", "INV-00099"} {
+		if _, err := op.FindByInvoice(number); !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("FindByInvoice(%q): got %v, want ErrOrderNotFound", number, err)
+		}
+	}
+}
+
+func TestInvoiceNumbersAfterImport(t *testing.T) {
+	op := NewOrderProcessor()
+	if _, err := op.ImportOrdersJSON([]byte(`[{"ID": 7, "Status": "paid", "InvoiceNumber": "INV-00041"}]`)); err != nil {
+		t.Fatalf("ImportOrdersJSON: %v", err)
+	}
+	order := newTestOrder(t, op, PaymentCard, CartItem{Product: testCharger, Quantity: 1})
+	if err := op.Pay(order, nil); err != nil {
+		t.Fatalf("Pay: %v", err)
+	}
+	if order.InvoiceNumber != "INV-00042" {
+		t.Errorf("invoice after import = %q, want INV-00042", order.InvoiceNumber)
+	}
+	if o, err := op.FindByInvoice("INV-00041"); err != nil || o.ID != 7 {
+		t.Errorf("FindByInvoice(INV-00041) = %v, %v; want the imported order", o, err)
+	}
+}